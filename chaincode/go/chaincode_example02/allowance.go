@@ -0,0 +1,146 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// An allowance lets a spender move up to an amount of the owner's tokens with
+// transferFrom, as in ERC-20. The owner of approve and the spender of transferFrom
+// are always the caller.
+//
+//	allowance composite key "allowance" {symbol, owner, spender}  decimal string, missing is 0
+const allowanceObjectType = "allowance"
+
+func getAllowance(stub shim.ChaincodeStubInterface, asset *Asset, owner string, spender string) (Amount, error) {
+	key, err := stub.CreateCompositeKey(allowanceObjectType, []string{asset.Symbol, owner, spender})
+	if err != nil {
+		return 0, err
+	}
+	allowancebytes, err := stub.GetState(key)
+	if err != nil || allowancebytes == nil {
+		return 0, err
+	}
+	allowance, err := ParseAmount(string(allowancebytes), asset.Decimals)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid stored allowance of %s for %s: %s", asset.Symbol, spender, err)
+	}
+	return allowance, nil
+}
+
+// putAllowance deletes zero allowances
+func putAllowance(stub shim.ChaincodeStubInterface, asset *Asset, owner string, spender string, allowance Amount) error {
+	key, err := stub.CreateCompositeKey(allowanceObjectType, []string{asset.Symbol, owner, spender})
+	if err != nil {
+		return err
+	}
+	if allowance == 0 {
+		return stub.DelState(key)
+	}
+	return stub.PutState(key, []byte(allowance.Format(asset.Decimals)))
+}
+
+// approve args: symbol, spender, amount. Replaces the allowance the caller gave
+// the spender, "0" revokes it.
+func (t *SimpleChaincode) approve(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 3")
+	}
+	asset, err := mustGetAsset(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	owner, err := clientAccount(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if args[1] == "" || args[1] == owner {
+		return failure(codeArgumentsError, "Expecting a spender other than the caller")
+	}
+	allowance, err := ParseAmount(args[2], asset.Decimals)
+	if err != nil {
+		return failure(codeArgumentsError, fmt.Sprintf("Invalid amount, expecting an amount with at most %d decimals", asset.Decimals))
+	}
+
+	err = putAllowance(stub, asset, owner, args[1], allowance)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("Approve %s %s of %s for %s\n", allowance.Format(asset.Decimals), asset.Symbol, owner, args[1])
+	return success(nil)
+}
+
+// allowance args: symbol, owner, spender, returns what spender may still transfer
+func (t *SimpleChaincode) allowance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 3")
+	}
+	asset, err := mustGetAsset(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	allowance, err := getAllowance(stub, asset, args[1], args[2])
+	if err != nil {
+		return errorResponse(err)
+	}
+	return success(allowance.Format(asset.Decimals))
+}
+
+// transferFrom args: symbol, from, to, amount. The caller spends the allowance from gave it.
+func (t *SimpleChaincode) transferFrom(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 4")
+	}
+	asset, err := mustGetAsset(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	spender, err := clientAccount(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if args[2] == "" {
+		return failure(codeArgumentsError, "Expecting a non-empty account")
+	}
+	amount, err := parseTransferAmount(args[3], asset)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	allowance, err := getAllowance(stub, asset, args[1], spender)
+	if err != nil {
+		return errorResponse(err)
+	}
+	allowance, err = allowance.Sub(amount)
+	if err == ErrInsufficientFunds {
+		return failure(codeInsufficientFunds, "Insufficient allowance: "+args[1]+" approved less than the amount for "+spender)
+	}
+	err = moveBalance(stub, asset, args[1], args[2], amount)
+	if err != nil {
+		return fundsError(err, args[1])
+	}
+	err = putAllowance(stub, asset, args[1], spender, allowance)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("TransferFrom %s %s from %s to %s by %s\n", amount.Format(asset.Decimals), asset.Symbol, args[1], args[2], spender)
+	return success(nil)
+}
@@ -0,0 +1,96 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MaxScale is the most decimals an amount can have, 10^18 still fits an int64
+const MaxScale = 18
+
+var (
+	ErrInvalidAmount     = errors.New("invalid amount")
+	ErrAmountOverflow    = errors.New("amount overflow")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+)
+
+// Amount is a non-negative fixed-point decimal: the value times 10^scale. The scale
+// is not part of the amount, callers keep track of it (see getScale).
+type Amount int64
+
+// ParseAmount reads a decimal like "12" or "12.50" with at most scale decimals
+func ParseAmount(s string, scale int) (Amount, error) {
+	if scale < 0 || scale > MaxScale {
+		return 0, ErrInvalidAmount
+	}
+	whole, fraction := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, fraction = s[:i], s[i+1:]
+		if len(fraction) == 0 {
+			return 0, ErrInvalidAmount
+		}
+	}
+	if len(whole) == 0 || len(fraction) > scale {
+		return 0, ErrInvalidAmount
+	}
+	fraction += strings.Repeat("0", scale-len(fraction))
+
+	var value Amount
+	for _, c := range whole + fraction {
+		if c < '0' || c > '9' {
+			return 0, ErrInvalidAmount
+		}
+		if value > (math.MaxInt64-Amount(c-'0'))/10 {
+			return 0, ErrAmountOverflow
+		}
+		value = value*10 + Amount(c-'0')
+	}
+	return value, nil
+}
+
+// Format writes the amount with exactly scale decimals, "12.50" for 1250 at scale 2
+func (a Amount) Format(scale int) string {
+	digits := []byte(strconv.FormatInt(int64(a), 10))
+	if scale == 0 {
+		return string(digits)
+	}
+	if len(digits) <= scale {
+		digits = append([]byte(strings.Repeat("0", scale-len(digits)+1)), digits...)
+	}
+	split := len(digits) - scale
+	return string(digits[:split]) + "." + string(digits[split:])
+}
+
+// Add returns ErrAmountOverflow instead of wrapping around
+func (a Amount) Add(b Amount) (Amount, error) {
+	if a > math.MaxInt64-b {
+		return 0, ErrAmountOverflow
+	}
+	return a + b, nil
+}
+
+// Sub returns ErrInsufficientFunds instead of going negative
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if b > a {
+		return 0, ErrInsufficientFunds
+	}
+	return a - b, nil
+}
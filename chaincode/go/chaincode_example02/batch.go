@@ -0,0 +1,120 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// maxBatchLegs bounds the read and write sets of a batchTransfer
+const maxBatchLegs = 500
+
+// batchPosition is what a batch does to one entity
+type batchPosition struct {
+	balance Amount
+	credits Amount
+	debits  Amount
+}
+
+// batchTransfer args: from, to, amount, repeated for every leg. The caller must own
+// every from entity. Only the balances after all legs must be non-negative, so a
+// leg may spend what an earlier or later leg credits. Nothing is written unless
+// every leg is valid.
+func (t *SimpleChaincode) batchTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) == 0 || len(args)%3 != 0 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting from, to and amount for every leg")
+	}
+	if len(args)/3 > maxBatchLegs {
+		return failure(codeArgumentsError, fmt.Sprintf("Expecting at most %d legs", maxBatchLegs))
+	}
+	scale, err := getScale(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	positions := make(map[string]*batchPosition)
+	var names []string // in order of appearance, writes do not depend on map order
+	for i := 0; i < len(args); i += 3 {
+		leg := i/3 + 1
+		from, to := args[i], args[i+1]
+		if from == to {
+			return failure(codeArgumentsError, fmt.Sprintf("Leg %d: expecting two different entities", leg))
+		}
+		amount, err := ParseAmount(args[i+2], scale)
+		if err != nil || amount == 0 {
+			return failure(codeArgumentsError, fmt.Sprintf("Leg %d: invalid transaction amount, expecting a positive amount with at most %d decimals", leg, scale))
+		}
+
+		for _, name := range []string{from, to} {
+			if positions[name] != nil {
+				continue
+			}
+			val, err := getAmount(stub, name, scale)
+			if err != nil {
+				return errorResponse(err)
+			}
+			if val == nil {
+				return failure(codeNotFound, "Entity not found: "+name)
+			}
+			positions[name] = &batchPosition{balance: *val}
+			names = append(names, name)
+		}
+		if positions[from].debits == 0 {
+			err = checkOwner(stub, from)
+			if err != nil {
+				if e, ok := err.(*codeError); ok {
+					err = newCodeError(e.code, fmt.Sprintf("Leg %d: %s", leg, e.message))
+				}
+				return errorResponse(err)
+			}
+		}
+
+		positions[from].debits, err = positions[from].debits.Add(amount)
+		if err != nil {
+			return errorResponse(err)
+		}
+		positions[to].credits, err = positions[to].credits.Add(amount)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	for _, name := range names {
+		position := positions[name]
+		balance, err := position.balance.Add(position.credits)
+		if err != nil {
+			return errorResponse(err)
+		}
+		position.balance, err = balance.Sub(position.debits)
+		if err == ErrInsufficientFunds {
+			return failure(codeInsufficientFunds, "Insufficient funds: "+name+" would hold less than 0 after all legs")
+		}
+	}
+
+	// Write the state back to the ledger
+	for _, name := range names {
+		err = putAmount(stub, name, positions[name].balance, scale)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	fmt.Printf("Batch of %d legs settled over %d entities\n", len(args)/3, len(names))
+	return success(nil)
+}
@@ -23,6 +23,7 @@ package main
 //hard-coding.
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 
@@ -34,42 +35,168 @@ import (
 type SimpleChaincode struct {
 }
 
+// Asset holdings are fixed-point decimals with the scale given to Init, stored as
+// decimal strings: "123" at scale 0, "123.45" at scale 2. The scale is kept under a
+// composite key, which can not clash with an entity name.
+const configObjectType = "ex02config"
+
+func scaleKey(stub shim.ChaincodeStubInterface) (string, error) {
+	return stub.CreateCompositeKey(configObjectType, []string{"scale"})
+}
+
+// getScale returns the scale set by Init, 0 if none was
+func getScale(stub shim.ChaincodeStubInterface) (int, error) {
+	key, err := scaleKey(stub)
+	if err != nil {
+		return 0, err
+	}
+	scalebytes, err := stub.GetState(key)
+	if err != nil || scalebytes == nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(scalebytes))
+}
+
+// getAmount reads the holding of an entity, nil if the entity does not exist. The
+// deltas of an entity with delta writes are part of its holding.
+//
+// Holdings written before amounts were decimals may be negative, which is no longer
+// an amount; they answer codeInvalidState until Init names the entity with a new
+// holding (binding it to the caller if it has no owner), after which it can be used
+// or deleted again. Init and delete never read the stored holding.
+func getAmount(stub shim.ChaincodeStubInterface, name string, scale int) (*Amount, error) {
+	valbytes, err := stub.GetState(name)
+	if err != nil {
+		return nil, errors.New("Failed to get state")
+	}
+	if valbytes == nil {
+		return nil, nil
+	}
+	val, err := ParseAmount(string(valbytes), scale)
+	if err != nil {
+		if legacy, legacyErr := strconv.ParseInt(string(valbytes), 10, 64); legacyErr == nil && legacy < 0 {
+			return nil, newCodeError(codeInvalidState, fmt.Sprintf("Holding %s of %s is negative, Init must set it again", valbytes, name))
+		}
+		return nil, fmt.Errorf("Invalid stored amount for %s: %s", name, err)
+	}
+	deltaMode, err := deltaWrites(stub, name)
+	if err != nil || !deltaMode {
+		return &val, err
+	}
+	deltas, _, err := sumDeltas(stub, name, scale)
+	if err != nil {
+		return nil, err
+	}
+	val, err = val.Add(deltas)
+	return &val, err
+}
+
+// putAmount sets the holding of an entity, replacing its deltas
+func putAmount(stub shim.ChaincodeStubInterface, name string, val Amount, scale int) error {
+	deltaMode, err := deltaWrites(stub, name)
+	if err != nil {
+		return err
+	}
+	if deltaMode {
+		_, err = delDeltas(stub, name, scale)
+		if err != nil {
+			return err
+		}
+	}
+	return stub.PutState(name, []byte(val.Format(scale)))
+}
+
+// Init args: A, Aval, B, Bval and optionally the scale, 0 by default. The scale can
+// not change once set, stored amounts would be misread. A and B are bound to the
+// caller unless they already have an owner.
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	fmt.Println("ex02 Init")
 	_, args := stub.GetFunctionAndParameters()
-	var A, B string    // Entities
-	var Aval, Bval int // Asset holdings
+	var A, B string       // Entities
+	var Aval, Bval Amount // Asset holdings
 	var err error
 
-	if len(args) != 4 {
-		return shim.Error("Incorrect number of arguments. Expecting 4")
+	if len(args) != 4 && len(args) != 5 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 4 or 5")
+	}
+
+	key, err := scaleKey(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	scalebytes, err := stub.GetState(key)
+	if err != nil {
+		return failure(codeSystemError, "Failed to get state")
+	}
+	scale := 0
+	if scalebytes != nil {
+		scale, err = strconv.Atoi(string(scalebytes))
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	if len(args) == 5 {
+		newScale, err := strconv.Atoi(args[4])
+		if err != nil || newScale < 0 || newScale > MaxScale {
+			return failure(codeArgumentsError, fmt.Sprintf("Expecting a scale from 0 to %d", MaxScale))
+		}
+		if scalebytes != nil && newScale != scale {
+			return failure(codeInvalidState, fmt.Sprintf("The scale is %d and can not be changed", scale))
+		}
+		scale = newScale
 	}
 
 	// Initialize the chaincode
 	A = args[0]
-	Aval, err = strconv.Atoi(args[1])
+	Aval, err = ParseAmount(args[1], scale)
 	if err != nil {
-		return shim.Error("Expecting integer value for asset holding")
+		return failure(codeArgumentsError, fmt.Sprintf("Expecting a non-negative amount with at most %d decimals for asset holding: %s", scale, err))
 	}
 	B = args[2]
-	Bval, err = strconv.Atoi(args[3])
+	Bval, err = ParseAmount(args[3], scale)
 	if err != nil {
-		return shim.Error("Expecting integer value for asset holding")
+		return failure(codeArgumentsError, fmt.Sprintf("Expecting a non-negative amount with at most %d decimals for asset holding: %s", scale, err))
 	}
-	fmt.Printf("Aval = %d, Bval = %d\n", Aval, Bval)
+	fmt.Printf("Aval = %s, Bval = %s\n", Aval.Format(scale), Bval.Format(scale))
 
 	// Write the state to the ledger
-	err = stub.PutState(A, []byte(strconv.Itoa(Aval)))
+	err = stub.PutState(key, []byte(strconv.Itoa(scale)))
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 
-	err = stub.PutState(B, []byte(strconv.Itoa(Bval)))
+	err = putAmount(stub, A, Aval, scale)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 
-	return shim.Success(nil)
+	err = putAmount(stub, B, Bval, scale)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	for _, name := range []string{A, B} {
+		err = t.bindUnowned(stub, name)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+
+	return success(nil)
+}
+
+// bindUnowned binds an entity to the caller if it has no owner yet
+func (t *SimpleChaincode) bindUnowned(stub shim.ChaincodeStubInterface, name string) error {
+	owner, err := getOwner(stub, name)
+	if err != nil || owner != "" {
+		return err
+	}
+	caller, err := clientAccount(stub)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is bound to %s\n", name, caller)
+	return putOwner(stub, name, caller)
 }
 
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
@@ -78,89 +205,243 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	if function == "invoke" {
 		// Make payment of X units from A to B
 		return t.invoke(stub, args)
+	} else if function == "batchTransfer" {
+		// Settles a list of payments at once
+		return t.batchTransfer(stub, args)
 	} else if function == "delete" {
 		// Deletes an entity from its state
 		return t.delete(stub, args)
 	} else if function == "query" {
 		// the old "Query" is now implemtned in invoke
 		return t.query(stub, args)
+	} else if function == "createAccount" {
+		// Creates an empty entity owned by the caller
+		return t.createAccount(stub, args)
+	} else if function == "changeOwner" {
+		// Hands an entity of the caller to another identity
+		return t.changeOwner(stub, args)
+	} else if function == "createAsset" {
+		// Creates a token, the caller is its issuer
+		return t.createAsset(stub, args)
+	} else if function == "assetInfo" {
+		return t.assetInfo(stub, args)
+	} else if function == "mint" {
+		return t.mint(stub, args)
+	} else if function == "burn" {
+		return t.burn(stub, args)
+	} else if function == "transfer" {
+		// Moves tokens from the caller to an account
+		return t.transfer(stub, args)
+	} else if function == "balanceOf" {
+		return t.balanceOf(stub, args)
+	} else if function == "totalSupply" {
+		return t.totalSupply(stub, args)
+	} else if function == "approve" {
+		// Lets a spender transfer tokens of the caller
+		return t.approve(stub, args)
+	} else if function == "allowance" {
+		return t.allowance(stub, args)
+	} else if function == "transferFrom" {
+		// Spends an allowance given to the caller
+		return t.transferFrom(stub, args)
+	} else if function == "getAccountHistory" {
+		// Lists the balance changes of an entity or token account
+		return t.getAccountHistory(stub, args)
+	} else if function == "getAccountStatement" {
+		// Adds up the debits and credits of an account over a time window
+		return t.getAccountStatement(stub, args)
+	} else if function == "lock" {
+		// Holds a payment under a hashlock until claimed or expired
+		return t.lock(stub, args)
+	} else if function == "claim" {
+		// Releases a held payment with the preimage of its hashlock
+		return t.claim(stub, args)
+	} else if function == "refund" {
+		// Returns an expired payment to its payer
+		return t.refund(stub, args)
+	} else if function == "escrowInfo" {
+		return t.escrowInfo(stub, args)
+	} else if function == "setDeltaWrites" {
+		// Lets an entity receive concurrent payments
+		return t.setDeltaWrites(stub, args)
+	} else if function == "compact" {
+		// Folds the deltas of an entity into its holding
+		return t.compact(stub, args)
 	}
 
-	return shim.Error("Invalid invoke function name. Expecting \"invoke\" \"delete\" \"query\"")
+	return failure(codeArgumentsError, "Invalid invoke function name. Expecting \"invoke\" \"batchTransfer\" \"delete\" \"query\" \"createAccount\" \"changeOwner\" "+
+		"\"createAsset\" \"assetInfo\" \"mint\" \"burn\" \"transfer\" \"balanceOf\" \"totalSupply\" "+
+		"\"approve\" \"allowance\" \"transferFrom\" \"getAccountHistory\" \"getAccountStatement\" "+
+		"\"lock\" \"claim\" \"refund\" \"escrowInfo\" \"setDeltaWrites\" \"compact\"")
 }
 
-// Transaction makes payment of X units from A to B
+// Transaction makes payment of X units from A to B, the caller must own A
 func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var A, B string    // Entities
-	var Aval, Bval int // Asset holdings
-	var X int          // Transaction value
+	var A, B string  // Entities
+	var Aval *Amount // Asset holding
+	var X Amount     // Transaction value
 	var err error
 
 	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 3")
 	}
 
 	A = args[0]
 	B = args[1]
+	if A == B {
+		return failure(codeArgumentsError, "Expecting two different entities")
+	}
+	err = checkOwner(stub, A)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	scale, err := getScale(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
 
 	// Get the state from the ledger
 	// TODO: will be nice to have a GetAllState call to ledger
-	Avalbytes, err := stub.GetState(A)
+	Aval, err = getAmount(stub, A, scale)
 	if err != nil {
-		return shim.Error("Failed to get state")
+		return errorResponse(err)
+	}
+	if Aval == nil {
+		return failure(codeNotFound, "Entity not found")
+	}
+
+	// Perform the execution
+	X, err = ParseAmount(args[2], scale)
+	if err != nil || X == 0 {
+		return failure(codeArgumentsError, fmt.Sprintf("Invalid transaction amount, expecting a positive amount with at most %d decimals", scale))
 	}
-	if Avalbytes == nil {
-		return shim.Error("Entity not found")
+	*Aval, err = Aval.Sub(X)
+	if err == ErrInsufficientFunds {
+		return failure(codeInsufficientFunds, "Insufficient funds: "+A+" holds less than "+X.Format(scale))
 	}
-	Aval, _ = strconv.Atoi(string(Avalbytes))
+	fmt.Printf("Aval = %s\n", Aval.Format(scale))
 
-	Bvalbytes, err := stub.GetState(B)
+	// Write the state back to the ledger, B is credited without reading its
+	// holding if it has delta writes
+	err = creditAmount(stub, B, X, scale)
 	if err != nil {
-		return shim.Error("Failed to get state")
+		return errorResponse(err)
 	}
-	if Bvalbytes == nil {
-		return shim.Error("Entity not found")
+
+	err = putAmount(stub, A, *Aval, scale)
+	if err != nil {
+		return errorResponse(err)
 	}
-	Bval, _ = strconv.Atoi(string(Bvalbytes))
 
-	// Perform the execution
-	X, err = strconv.Atoi(args[2])
+	return success(nil)
+}
+
+// Deletes an entity of the caller from state, unless it is party to a locked escrow
+func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 1")
+	}
+
+	A := args[0]
+	err := checkOwner(stub, A)
 	if err != nil {
-		return shim.Error("Invalid transaction amount, expecting a integer value")
+		return errorResponse(err)
+	}
+	// a locked escrow pays A back or pays A, it could never settle
+	locked, err := hasLockedEscrow(stub, A)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if locked {
+		return failure(codeInvalidState, "Entity "+A+" has locked escrows, claim or refund them first")
 	}
-	Aval = Aval - X
-	Bval = Bval + X
-	fmt.Printf("Aval = %d, Bval = %d\n", Aval, Bval)
 
-	// Write the state back to the ledger
-	err = stub.PutState(A, []byte(strconv.Itoa(Aval)))
+	scale, err := getScale(stub)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 
-	err = stub.PutState(B, []byte(strconv.Itoa(Bval)))
+	// Delete the key from the state in ledger
+	err = stub.DelState(A)
+	if err != nil {
+		return failure(codeSystemError, "Failed to delete state")
+	}
+	err = delOwner(stub, A)
 	if err != nil {
-		return shim.Error(err.Error())
+		return failure(codeSystemError, "Failed to delete state")
+	}
+	err = delDeltaWrites(stub, A, scale)
+	if err != nil {
+		return errorResponse(err)
 	}
 
-	return shim.Success(nil)
+	return success(nil)
 }
 
-// Deletes an entity from state
-func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// createAccount args: name, creates the entity with nothing, owned by the caller
+func (t *SimpleChaincode) createAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 1")
 	}
 
 	A := args[0]
+	if A == "" {
+		return failure(codeArgumentsError, "Expecting a non-empty name")
+	}
+	scale, err := getScale(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	Aval, err := getAmount(stub, A, scale)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if Aval != nil {
+		return failure(codeAlreadyExists, "Entity already exists: "+A)
+	}
 
-	// Delete the key from the state in ledger
-	err := stub.DelState(A)
+	caller, err := clientAccount(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	err = putAmount(stub, A, 0, scale)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = putOwner(stub, A, caller)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return success(nil)
+}
+
+// changeOwner args: name, new owner account, the caller must own the entity
+func (t *SimpleChaincode) changeOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 2")
+	}
+	if args[1] == "" {
+		return failure(codeArgumentsError, "Expecting a non-empty owner")
+	}
+	err := checkOwner(stub, args[0])
 	if err != nil {
-		return shim.Error("Failed to delete state")
+		return errorResponse(err)
 	}
+	err = putOwner(stub, args[0], args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("%s is bound to %s\n", args[0], args[1])
+	return success(nil)
+}
 
-	return shim.Success(nil)
+// QueryResponse is the data of the Response of query
+type QueryResponse struct {
+	Name   string `json:"name"`
+	Amount string `json:"amount"`
+	Owner  string `json:"owner"` // client account, "" if the entity is not bound
 }
 
 // query callback representing the query of a chaincode
@@ -169,26 +450,34 @@ func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string)
 	var err error
 
 	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting name of the person to query")
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting name of the person to query")
 	}
 
 	A = args[0]
 
+	scale, err := getScale(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
 	// Get the state from the ledger
-	Avalbytes, err := stub.GetState(A)
+	Aval, err := getAmount(stub, A, scale)
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + A + "\"}"
-		return shim.Error(jsonResp)
+		return errorResponse(err)
 	}
 
-	if Avalbytes == nil {
-		jsonResp := "{\"Error\":\"Nil amount for " + A + "\"}"
-		return shim.Error(jsonResp)
+	if Aval == nil {
+		return failure(codeNotFound, "Nil amount for "+A)
+	}
+
+	owner, err := getOwner(stub, A)
+	if err != nil {
+		return failure(codeSystemError, "Failed to get owner for "+A)
 	}
 
-	jsonResp := "{\"Name\":\"" + A + "\",\"Amount\":\"" + string(Avalbytes) + "\"}"
-	fmt.Printf("Query Response:%s\n", jsonResp)
-	return shim.Success(Avalbytes)
+	queryResponse := QueryResponse{A, Aval.Format(scale), owner}
+	fmt.Printf("Query Response:%+v\n", queryResponse)
+	return success(queryResponse)
 }
 
 func main() {
@@ -16,12 +16,27 @@ limitations under the License.
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/examples/chaincode/go/hashutil"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
+// testAdmin runs the tests unless they set another caller, it owns the entities of Init
+const testAdmin = "Org1MSP/admin"
+
+func init() {
+	setCaller(testAdmin)
+}
+
 func checkInit(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	res := stub.MockInit("1", args)
 	if res.Status != shim.OK {
@@ -52,7 +67,13 @@ func checkQuery(t *testing.T, stub *shim.MockStub, name string, value string) {
 		fmt.Println("Query", name, "failed to get value")
 		t.FailNow()
 	}
-	if string(res.Payload) != value {
+	var queryResponse QueryResponse
+	err := responseData(res, &queryResponse)
+	if err != nil {
+		fmt.Println("Query", name, "returned", string(res.Payload), err)
+		t.FailNow()
+	}
+	if queryResponse.Amount != value {
 		fmt.Println("Query value", name, "was not", value, "as expected")
 		t.FailNow()
 	}
@@ -110,3 +131,550 @@ func TestExample02_Invoke(t *testing.T) {
 	checkQuery(t, stub, "A", "678")
 	checkQuery(t, stub, "B", "567")
 }
+
+func checkInvokeFails(t *testing.T, stub *shim.MockStub, args [][]byte, message string) {
+	res := stub.MockInvoke("1", args)
+	if res.Status == shim.OK {
+		fmt.Println("Invoke", args, "succeeded, expected", message)
+		t.FailNow()
+	}
+	if !strings.Contains(res.Message, message) {
+		fmt.Println("Invoke", args, "failed with", res.Message, "expected", message)
+		t.FailNow()
+	}
+}
+
+// checkInvokeCode checks the status and the Response code of a failure
+func checkInvokeCode(t *testing.T, stub *shim.MockStub, args [][]byte, status int32, code string) {
+	res := stub.MockInvoke("1", args)
+	var response Response
+	err := json.Unmarshal(res.Payload, &response)
+	if err != nil || res.Status != status || response.Code != code || response.Version != responseVersion ||
+		response.Error == "" || res.Message != string(res.Payload) {
+		fmt.Println("Invoke", args, "returned", res.Status, string(res.Payload), "expected", status, code)
+		t.FailNow()
+	}
+}
+
+func TestExample02_Response(t *testing.T) {
+	scc := new(SimpleChaincode)
+	stub := shim.NewMockStub("ex02", scc)
+	defer setCaller(testAdmin)
+
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("100"), []byte("B"), []byte("200")})
+	checkInvokePayload(t, stub, [][]byte{[]byte("query"), []byte("A")}, `{"name":"A","amount":"100","owner":"Org1MSP/admin"}`)
+	res := stub.MockInvoke("1", [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("10")})
+	var response Response
+	if json.Unmarshal(res.Payload, &response) != nil || response.Code != codeSuccess || response.Data != nil {
+		fmt.Println("Invoke returned", string(res.Payload))
+		t.FailNow()
+	}
+
+	checkInvokeCode(t, stub, [][]byte{[]byte("nope")}, shim.ERRORTHRESHOLD, codeArgumentsError)
+	checkInvokeCode(t, stub, [][]byte{[]byte("query"), []byte("C")}, shim.ERRORTHRESHOLD, codeNotFound)
+	checkInvokeCode(t, stub, [][]byte{[]byte("createAccount"), []byte("B")}, shim.ERRORTHRESHOLD, codeAlreadyExists)
+	checkInvokeCode(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("91")}, shim.ERRORTHRESHOLD, codeInsufficientFunds)
+	checkInvokeCode(t, stub, [][]byte{[]byte("assetInfo"), []byte("GLD")}, shim.ERRORTHRESHOLD, codeNotFound)
+	setCaller("Org1MSP/alice")
+	checkInvokeCode(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("1")}, shim.ERRORTHRESHOLD, codePermissionDenied)
+
+	// a corrupted holding is a system error
+	stub.MockTransactionStart("x")
+	stub.PutState("B", []byte("abc"))
+	stub.MockTransactionEnd("x")
+	setCaller(testAdmin)
+	checkInvokeCode(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("1")}, shim.ERROR, codeSystemError)
+}
+
+func TestExample02_Decimals(t *testing.T) {
+	scc := new(SimpleChaincode)
+	stub := shim.NewMockStub("ex02", scc)
+
+	// Init A=10.5 B=0.25 with 2 decimals
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("10.5"), []byte("B"), []byte("0.25"), []byte("2")})
+	checkState(t, stub, "A", "10.50")
+	checkState(t, stub, "B", "0.25")
+
+	// Invoke A->B for 0.75
+	checkInvoke(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("0.75")})
+	checkQuery(t, stub, "A", "9.75")
+	checkQuery(t, stub, "B", "1.00")
+
+	// the scale is kept by a later init and can not change
+	res := stub.MockInit("2", [][]byte{[]byte("init"), []byte("A"), []byte("1"), []byte("B"), []byte("2")})
+	if res.Status != shim.OK {
+		fmt.Println("Init failed", res.Message)
+		t.FailNow()
+	}
+	checkState(t, stub, "A", "1.00")
+	res = stub.MockInit("3", [][]byte{[]byte("init"), []byte("A"), []byte("1"), []byte("B"), []byte("2"), []byte("3")})
+	if res.Status == shim.OK {
+		fmt.Println("Init changed the scale")
+		t.FailNow()
+	}
+}
+
+func TestExample02_InvokeRejects(t *testing.T) {
+	scc := new(SimpleChaincode)
+	stub := shim.NewMockStub("ex02", scc)
+
+	// Init A=100 B=9223372036854775800
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("100"), []byte("B"), []byte("9223372036854775800")})
+
+	checkInvokeFails(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("0")}, "Invalid transaction amount")
+	checkInvokeFails(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("-5")}, "Invalid transaction amount")
+	checkInvokeFails(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("1.5")}, "Invalid transaction amount")
+	checkInvokeFails(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("101")}, "Insufficient funds")
+	checkInvokeFails(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("10")}, "overflow")
+	checkInvokeFails(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("A"), []byte("10")}, "two different entities")
+	checkQuery(t, stub, "A", "100")
+
+	// a corrupted holding is reported, not read as 0
+	stub.MockTransactionStart("x")
+	stub.PutState("A", []byte("abc"))
+	stub.MockTransactionEnd("x")
+	checkInvokeFails(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("1")}, "Invalid stored amount")
+}
+
+// setCaller makes every following transaction come from account
+func setCaller(account string) {
+	clientAccount = func(stub shim.ChaincodeStubInterface) (string, error) {
+		return account, nil
+	}
+}
+
+// responseData reads the data of a successful Response into data
+func responseData(res pb.Response, data interface{}) error {
+	response := Response{Data: data}
+	err := json.Unmarshal(res.Payload, &response)
+	if err == nil && response.Code != codeSuccess {
+		err = fmt.Errorf("code %s: %s", response.Code, response.Error)
+	}
+	return err
+}
+
+// checkInvokePayload compares the data of the Response as JSON
+func checkInvokePayload(t *testing.T, stub *shim.MockStub, args [][]byte, value string) {
+	res := stub.MockInvoke("1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.FailNow()
+	}
+	var data json.RawMessage
+	err := responseData(res, &data)
+	if err != nil || string(data) != value {
+		fmt.Println("Invoke", args, "returned", string(res.Payload), "not", value, "as expected")
+		t.FailNow()
+	}
+}
+
+func TestExample02_Token(t *testing.T) {
+	scc := new(SimpleChaincode)
+	stub := shim.NewMockStub("ex02", scc)
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("1"), []byte("B"), []byte("2")})
+
+	// Org1MSP/issuer creates GLD with 2 decimals and mints 100 for alice
+	defer setCaller(testAdmin)
+	setCaller("Org1MSP/issuer")
+	checkInvoke(t, stub, [][]byte{[]byte("createAsset"), []byte("GLD"), []byte("2"), []byte("Gold")})
+	checkInvokeFails(t, stub, [][]byte{[]byte("createAsset"), []byte("GLD"), []byte("0")}, "already exists")
+	checkInvoke(t, stub, [][]byte{[]byte("mint"), []byte("GLD"), []byte("Org1MSP/alice"), []byte("100")})
+	checkInvokePayload(t, stub, [][]byte{[]byte("assetInfo"), []byte("GLD")},
+		`{"symbol":"GLD","name":"Gold","decimals":2,"issuer":"Org1MSP/issuer","totalSupply":"100.00"}`)
+
+	// alice can not mint, transfers 30.5 to bob and burns 9.5
+	setCaller("Org1MSP/alice")
+	checkInvokeFails(t, stub, [][]byte{[]byte("mint"), []byte("GLD"), []byte("Org1MSP/alice"), []byte("1")}, "Only the issuer")
+	checkInvoke(t, stub, [][]byte{[]byte("transfer"), []byte("GLD"), []byte("Org2MSP/bob"), []byte("30.5")})
+	checkInvoke(t, stub, [][]byte{[]byte("burn"), []byte("GLD"), []byte("9.5")})
+	checkInvokeFails(t, stub, [][]byte{[]byte("transfer"), []byte("GLD"), []byte("Org2MSP/bob"), []byte("60.01")}, "Insufficient funds")
+	checkInvokeFails(t, stub, [][]byte{[]byte("transfer"), []byte("GLD"), []byte("Org2MSP/bob"), []byte("0")}, "positive amount")
+	checkInvokeFails(t, stub, [][]byte{[]byte("transfer"), []byte("SLV"), []byte("Org2MSP/bob"), []byte("1")}, "Asset not found")
+
+	checkInvokePayload(t, stub, [][]byte{[]byte("balanceOf"), []byte("GLD"), []byte("Org1MSP/alice")}, `"60.00"`)
+	checkInvokePayload(t, stub, [][]byte{[]byte("balanceOf"), []byte("GLD"), []byte("Org2MSP/bob")}, `"30.50"`)
+	checkInvokePayload(t, stub, [][]byte{[]byte("balanceOf"), []byte("GLD"), []byte("Org2MSP/carol")}, `"0.00"`)
+	checkInvokePayload(t, stub, [][]byte{[]byte("totalSupply"), []byte("GLD")}, `"90.50"`)
+
+	// the entities of invoke/query are untouched
+	checkQuery(t, stub, "A", "1")
+}
+
+func TestExample02_Allowance(t *testing.T) {
+	scc := new(SimpleChaincode)
+	stub := shim.NewMockStub("ex02", scc)
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("1"), []byte("B"), []byte("2")})
+
+	defer setCaller(testAdmin)
+	setCaller("Org1MSP/issuer")
+	checkInvoke(t, stub, [][]byte{[]byte("createAsset"), []byte("GLD"), []byte("0")})
+	checkInvoke(t, stub, [][]byte{[]byte("mint"), []byte("GLD"), []byte("Org1MSP/alice"), []byte("100")})
+
+	// alice lets bob spend 40
+	setCaller("Org1MSP/alice")
+	checkInvoke(t, stub, [][]byte{[]byte("approve"), []byte("GLD"), []byte("Org2MSP/bob"), []byte("40")})
+	checkInvokePayload(t, stub, [][]byte{[]byte("allowance"), []byte("GLD"), []byte("Org1MSP/alice"), []byte("Org2MSP/bob")}, `"40"`)
+
+	// carol has no allowance, bob spends 25 then can not exceed the 15 left
+	setCaller("Org2MSP/carol")
+	checkInvokeFails(t, stub, [][]byte{[]byte("transferFrom"), []byte("GLD"), []byte("Org1MSP/alice"), []byte("Org2MSP/carol"), []byte("1")}, "Insufficient allowance")
+	setCaller("Org2MSP/bob")
+	checkInvoke(t, stub, [][]byte{[]byte("transferFrom"), []byte("GLD"), []byte("Org1MSP/alice"), []byte("Org2MSP/carol"), []byte("25")})
+	checkInvokeFails(t, stub, [][]byte{[]byte("transferFrom"), []byte("GLD"), []byte("Org1MSP/alice"), []byte("Org2MSP/carol"), []byte("16")}, "Insufficient allowance")
+	checkInvokePayload(t, stub, [][]byte{[]byte("allowance"), []byte("GLD"), []byte("Org1MSP/alice"), []byte("Org2MSP/bob")}, `"15"`)
+	checkInvokePayload(t, stub, [][]byte{[]byte("balanceOf"), []byte("GLD"), []byte("Org1MSP/alice")}, `"75"`)
+	checkInvokePayload(t, stub, [][]byte{[]byte("balanceOf"), []byte("GLD"), []byte("Org2MSP/carol")}, `"25"`)
+
+	// the allowance does not make up for missing funds
+	setCaller("Org1MSP/alice")
+	checkInvoke(t, stub, [][]byte{[]byte("approve"), []byte("GLD"), []byte("Org2MSP/bob"), []byte("500")})
+	setCaller("Org2MSP/bob")
+	checkInvokeFails(t, stub, [][]byte{[]byte("transferFrom"), []byte("GLD"), []byte("Org1MSP/alice"), []byte("Org2MSP/bob"), []byte("76")}, "Insufficient funds")
+	checkInvokePayload(t, stub, [][]byte{[]byte("allowance"), []byte("GLD"), []byte("Org1MSP/alice"), []byte("Org2MSP/bob")}, `"500"`)
+
+	// 0 revokes
+	setCaller("Org1MSP/alice")
+	checkInvoke(t, stub, [][]byte{[]byte("approve"), []byte("GLD"), []byte("Org2MSP/bob"), []byte("0")})
+	checkInvokePayload(t, stub, [][]byte{[]byte("allowance"), []byte("GLD"), []byte("Org1MSP/alice"), []byte("Org2MSP/bob")}, `"0"`)
+}
+
+func TestExample02_Owner(t *testing.T) {
+	scc := new(SimpleChaincode)
+	stub := shim.NewMockStub("ex02", scc)
+	defer setCaller(testAdmin)
+
+	// Init binds A and B to the admin
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("100"), []byte("B"), []byte("200")})
+	checkInvokePayload(t, stub, [][]byte{[]byte("query"), []byte("A")}, `{"name":"A","amount":"100","owner":"Org1MSP/admin"}`)
+
+	// alice opens C and can not pay from A
+	setCaller("Org1MSP/alice")
+	checkInvoke(t, stub, [][]byte{[]byte("createAccount"), []byte("C")})
+	checkInvokeFails(t, stub, [][]byte{[]byte("createAccount"), []byte("A")}, "already exists")
+	checkInvokeFails(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("C"), []byte("10")}, "belongs to Org1MSP/admin")
+	checkInvokeFails(t, stub, [][]byte{[]byte("delete"), []byte("A")}, "belongs to Org1MSP/admin")
+	checkInvokeFails(t, stub, [][]byte{[]byte("changeOwner"), []byte("A"), []byte("Org1MSP/alice")}, "belongs to Org1MSP/admin")
+
+	// the admin pays alice and hands B to her
+	setCaller(testAdmin)
+	checkInvoke(t, stub, [][]byte{[]byte("invoke"), []byte("A"), []byte("C"), []byte("10")})
+	checkInvoke(t, stub, [][]byte{[]byte("changeOwner"), []byte("B"), []byte("Org1MSP/alice")})
+	checkInvokeFails(t, stub, [][]byte{[]byte("invoke"), []byte("B"), []byte("A"), []byte("1")}, "belongs to Org1MSP/alice")
+
+	setCaller("Org1MSP/alice")
+	checkInvoke(t, stub, [][]byte{[]byte("invoke"), []byte("B"), []byte("C"), []byte("5")})
+	checkInvokePayload(t, stub, [][]byte{[]byte("query"), []byte("C")}, `{"name":"C","amount":"15","owner":"Org1MSP/alice"}`)
+
+	// a later init keeps the owners
+	setCaller(testAdmin)
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("100"), []byte("B"), []byte("200")})
+	checkInvokePayload(t, stub, [][]byte{[]byte("query"), []byte("B")}, `{"name":"B","amount":"200","owner":"Org1MSP/alice"}`)
+}
+
+func TestExample02_LegacyAmount(t *testing.T) {
+	scc := new(SimpleChaincode)
+	stub := shim.NewMockStub("ex02", scc)
+
+	// holdings of the integer chaincode could be negative, and had no owner
+	stub.State["A"] = []byte("-5")
+	stub.State["B"] = []byte("7")
+	checkInvokeFails(t, stub, [][]byte{[]byte("query"), []byte("A")}, "Holding -5 of A is negative")
+	checkInvokeFails(t, stub, [][]byte{[]byte("invoke"), []byte("B"), []byte("A"), []byte("1")}, "not bound")
+
+	// Init sets the holding again and binds the entity, which can then be deleted
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("0"), []byte("B"), []byte("7")})
+	checkInvokePayload(t, stub, [][]byte{[]byte("query"), []byte("A")}, `{"name":"A","amount":"0","owner":"Org1MSP/admin"}`)
+	stub.State["A"] = []byte("-5")
+	checkInvoke(t, stub, [][]byte{[]byte("delete"), []byte("A")})
+	if stub.State["A"] != nil {
+		fmt.Println("A was not deleted")
+		t.FailNow()
+	}
+}
+
+func TestExample02_BatchTransfer(t *testing.T) {
+	scc := new(SimpleChaincode)
+	stub := shim.NewMockStub("ex02", scc)
+	defer setCaller(testAdmin)
+
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("100"), []byte("B"), []byte("50")})
+	checkInvoke(t, stub, [][]byte{[]byte("createAccount"), []byte("C")})
+
+	// B pays 120 to C before A covers it, only the net balances count
+	checkInvoke(t, stub, [][]byte{[]byte("batchTransfer"),
+		[]byte("B"), []byte("C"), []byte("120"),
+		[]byte("A"), []byte("B"), []byte("80"),
+		[]byte("C"), []byte("A"), []byte("20")})
+	checkQuery(t, stub, "A", "40")
+	checkQuery(t, stub, "B", "10")
+	checkQuery(t, stub, "C", "100")
+
+	// nothing is written when one leg fails
+	checkInvokeFails(t, stub, [][]byte{[]byte("batchTransfer"),
+		[]byte("A"), []byte("B"), []byte("30"),
+		[]byte("B"), []byte("C"), []byte("50")}, "B would hold less than 0")
+	checkInvokeFails(t, stub, [][]byte{[]byte("batchTransfer"),
+		[]byte("A"), []byte("B"), []byte("1"),
+		[]byte("A"), []byte("D"), []byte("1")}, "Entity not found: D")
+	checkInvokeFails(t, stub, [][]byte{[]byte("batchTransfer"),
+		[]byte("A"), []byte("B"), []byte("1"),
+		[]byte("B"), []byte("B"), []byte("1")}, "Leg 2: expecting two different entities")
+	checkInvokeFails(t, stub, [][]byte{[]byte("batchTransfer"), []byte("A"), []byte("B")}, "Incorrect number of arguments")
+	checkQuery(t, stub, "A", "40")
+	checkQuery(t, stub, "B", "10")
+	checkQuery(t, stub, "C", "100")
+
+	// every payer must belong to the caller
+	setCaller("Org1MSP/alice")
+	checkInvokeFails(t, stub, [][]byte{[]byte("batchTransfer"), []byte("A"), []byte("B"), []byte("1")}, "Leg 1: Entity A belongs to Org1MSP/admin")
+}
+
+// historyStub serves GetHistoryForKey, which MockStub does not implement
+type historyStub struct {
+	*shim.MockStub
+	history map[string][]*queryresult.KeyModification
+}
+
+type historyIterator struct {
+	modifications []*queryresult.KeyModification
+}
+
+func (it *historyIterator) HasNext() bool { return len(it.modifications) > 0 }
+
+func (it *historyIterator) Close() error { return nil }
+
+func (it *historyIterator) Next() (*queryresult.KeyModification, error) {
+	modification := it.modifications[0]
+	it.modifications = it.modifications[1:]
+	return modification, nil
+}
+
+func (stub *historyStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{stub.history[key]}, nil
+}
+
+func TestExample02_History(t *testing.T) {
+	scc := new(SimpleChaincode)
+	stub := shim.NewMockStub("ex02", scc)
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("130"), []byte("B"), []byte("200")})
+
+	// A is 100 on July 1st 2018, 90 on the 2nd, 130 on the 3rd and deleted on the 4th
+	day := int64(24 * 60 * 60)
+	july1 := int64(1530403200)
+	hstub := &historyStub{stub, map[string][]*queryresult.KeyModification{"A": {
+		{TxId: "tx1", Value: []byte("100"), Timestamp: &timestamp.Timestamp{Seconds: july1}},
+		{TxId: "tx2", Value: []byte("90"), Timestamp: &timestamp.Timestamp{Seconds: july1 + day}},
+		{TxId: "tx3", Value: []byte("130"), Timestamp: &timestamp.Timestamp{Seconds: july1 + 2*day}},
+		{TxId: "tx4", IsDelete: true, Timestamp: &timestamp.Timestamp{Seconds: july1 + 3*day}},
+	}, "B": {
+		// the client of tx6 has a slow clock, the history keeps commit order
+		{TxId: "tx5", Value: []byte("200"), Timestamp: &timestamp.Timestamp{Seconds: july1}},
+		{TxId: "tx6", Value: []byte("150"), Timestamp: &timestamp.Timestamp{Seconds: july1 + 2*day}},
+		{TxId: "tx7", Value: []byte("170"), Timestamp: &timestamp.Timestamp{Seconds: july1 + day}},
+		{TxId: "tx8", Value: []byte("100"), Timestamp: &timestamp.Timestamp{Seconds: july1 + 3*day}},
+	}}}
+
+	res := scc.getAccountHistory(hstub, []string{"A"})
+	var history []AccountChange
+	if res.Status != shim.OK || responseData(res, &history) != nil || len(history) != 4 {
+		fmt.Println("getAccountHistory failed", res.Message, string(res.Payload))
+		t.FailNow()
+	}
+	expected := []AccountChange{
+		{"tx1", "2018-07-01T00:00:00Z", "100", "+100", false},
+		{"tx2", "2018-07-02T00:00:00Z", "90", "-10", false},
+		{"tx3", "2018-07-03T00:00:00Z", "130", "+40", false},
+		{"tx4", "2018-07-04T00:00:00Z", "0", "-130", true},
+	}
+	for i := range expected {
+		if history[i] != expected[i] {
+			fmt.Println("History entry", i, "was", history[i], "not", expected[i])
+			t.FailNow()
+		}
+	}
+
+	res = scc.getAccountStatement(hstub, []string{"A", "2018-07-02T00:00:00Z", "2018-07-04T00:00:00Z"})
+	var statement AccountStatement
+	if res.Status != shim.OK || responseData(res, &statement) != nil {
+		fmt.Println("getAccountStatement failed", res.Message, string(res.Payload))
+		t.FailNow()
+	}
+	if statement.OpeningBalance != "100" || statement.Credits != "40" || statement.Debits != "10" ||
+		statement.ClosingBalance != "130" || len(statement.Changes) != 2 || statement.Changes[0].TxId != "tx2" {
+		fmt.Println("Unexpected statement", string(res.Payload))
+		t.FailNow()
+	}
+
+	res = scc.getAccountHistory(hstub, []string{"B"})
+	if res.Status != shim.OK || responseData(res, &history) != nil || len(history) != 4 ||
+		history[1].Change != "-50" || history[2].TxId != "tx7" || history[2].Change != "+20" {
+		fmt.Println("Unexpected history of B", string(res.Payload))
+		t.FailNow()
+	}
+	res = scc.getAccountStatement(hstub, []string{"B", "2018-07-02T00:00:00Z", "2018-07-04T00:00:00Z"})
+	if res.Status != shim.OK || responseData(res, &statement) != nil {
+		fmt.Println("getAccountStatement failed", res.Message, string(res.Payload))
+		t.FailNow()
+	}
+	if statement.OpeningBalance != "200" || statement.Credits != "20" || statement.Debits != "50" ||
+		statement.ClosingBalance != "170" || len(statement.Changes) != 2 {
+		fmt.Println("Unexpected statement of B", string(res.Payload))
+		t.FailNow()
+	}
+
+	res = scc.getAccountStatement(hstub, []string{"A", "2018-07-04T00:00:00Z", "2018-07-02T00:00:00Z"})
+	if res.Status == shim.OK || !strings.Contains(res.Message, "from before to") {
+		fmt.Println("getAccountStatement accepted an empty window", res.Message)
+		t.FailNow()
+	}
+}
+
+// clockStub runs a transaction at a given time, MockStub always uses the current one
+type clockStub struct {
+	*shim.MockStub
+	now time.Time
+}
+
+func (stub *clockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: stub.now.Unix(), Nanos: int32(stub.now.Nanosecond())}, nil
+}
+
+// invokeAt runs a transaction at now, with the endorser's clock at now too
+func invokeAt(stub *shim.MockStub, now time.Time, invoke func(shim.ChaincodeStubInterface) pb.Response) pb.Response {
+	localClock = func() time.Time { return now }
+	defer func() { localClock = time.Now }()
+	stub.MockTransactionStart("later")
+	defer stub.MockTransactionEnd("later")
+	return invoke(&clockStub{stub, now})
+}
+
+func TestExample02_Escrow(t *testing.T) {
+	scc := new(SimpleChaincode)
+	stub := shim.NewMockStub("ex02", scc)
+
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("100"), []byte("B"), []byte("50")})
+
+	// A locks 30 for B for an hour
+	hashlock := hashutil.SHA256Hex("secret")
+	res := stub.MockInvoke("lock1", [][]byte{[]byte("lock"), []byte("A"), []byte("B"), []byte("30"), []byte(hashlock), []byte("3600")})
+	var escrow Escrow
+	if res.Status != shim.OK || responseData(res, &escrow) != nil || escrow.Id != "lock1" || escrow.State != "locked" {
+		fmt.Println("Lock failed", res.Message, string(res.Payload))
+		t.FailNow()
+	}
+	checkQuery(t, stub, "A", "70")
+	checkQuery(t, stub, "B", "50")
+
+	checkInvokeFails(t, stub, [][]byte{[]byte("claim"), []byte("lock1"), []byte("guess")}, "does not match the hashlock")
+	checkInvokeFails(t, stub, [][]byte{[]byte("refund"), []byte("lock1")}, "can not be refunded before")
+	checkInvokeFails(t, stub, [][]byte{[]byte("delete"), []byte("A")}, "has locked escrows")
+	checkInvokeFails(t, stub, [][]byte{[]byte("delete"), []byte("B")}, "has locked escrows")
+
+	// an endorser rejects a timestamp far from its clock
+	stub.MockTransactionStart("skewed")
+	res = scc.claim(&clockStub{stub, time.Now().Add(-time.Hour)}, []string{"lock1", "secret"})
+	stub.MockTransactionEnd("skewed")
+	if res.Status == shim.OK || !strings.Contains(res.Message, "away from the endorser's clock") {
+		fmt.Println("Claim with a skewed timestamp did not fail", res.Message)
+		t.FailNow()
+	}
+
+	checkInvoke(t, stub, [][]byte{[]byte("claim"), []byte("lock1"), []byte("secret")})
+	checkQuery(t, stub, "B", "80")
+	checkInvokeFails(t, stub, [][]byte{[]byte("refund"), []byte("lock1")}, "already claimed")
+	res = stub.MockInvoke("1", [][]byte{[]byte("escrowInfo"), []byte("lock1")})
+	if res.Status != shim.OK || responseData(res, &escrow) != nil || escrow.State != "claimed" || escrow.Preimage != "secret" {
+		fmt.Println("escrowInfo failed", res.Message, string(res.Payload))
+		t.FailNow()
+	}
+
+	// a base64 hashlock for a minute, not claimed in time
+	hashlock = base64.StdEncoding.EncodeToString(hashutil.SHA256("other"))
+	checkInvoke(t, stub, [][]byte{[]byte("lock"), []byte("A"), []byte("B"), []byte("20"), []byte(hashlock), []byte("60")})
+	checkQuery(t, stub, "A", "50")
+	later := time.Now().Add(time.Hour)
+	res = invokeAt(stub, later, func(stub shim.ChaincodeStubInterface) pb.Response {
+		return scc.claim(stub, []string{"1", "other"})
+	})
+	if res.Status == shim.OK || !strings.Contains(res.Message, "expired") {
+		fmt.Println("Claim after the deadline did not fail", res.Message)
+		t.FailNow()
+	}
+	// only the owner of A refunds
+	setCaller("Org1MSP/alice")
+	res = invokeAt(stub, later, func(stub shim.ChaincodeStubInterface) pb.Response {
+		return scc.refund(stub, []string{"1"})
+	})
+	setCaller(testAdmin)
+	if res.Status == shim.OK || !strings.Contains(res.Message, "belongs to Org1MSP/admin") {
+		fmt.Println("Refund by another identity did not fail", res.Message)
+		t.FailNow()
+	}
+	res = invokeAt(stub, later, func(stub shim.ChaincodeStubInterface) pb.Response {
+		return scc.refund(stub, []string{"1"})
+	})
+	if res.Status != shim.OK {
+		fmt.Println("Refund failed", res.Message)
+		t.FailNow()
+	}
+	checkQuery(t, stub, "A", "70")
+	checkQuery(t, stub, "B", "80")
+
+	checkInvokeFails(t, stub, [][]byte{[]byte("lock"), []byte("A"), []byte("B"), []byte("71"), []byte(hashlock), []byte("60")}, "Insufficient funds")
+	checkInvokeFails(t, stub, [][]byte{[]byte("lock"), []byte("A"), []byte("B"), []byte("1"), []byte("abc"), []byte("60")}, "Invalid hashlock")
+	checkInvokeFails(t, stub, [][]byte{[]byte("lock"), []byte("A"), []byte("B"), []byte("1"), []byte(hashlock), []byte("0")}, "Expecting a lock time")
+
+	// settled escrows do not keep A from being deleted
+	checkInvoke(t, stub, [][]byte{[]byte("delete"), []byte("A")})
+}
+
+func TestExample02_DeltaWrites(t *testing.T) {
+	scc := new(SimpleChaincode)
+	stub := shim.NewMockStub("ex02", scc)
+
+	checkInit(t, stub, [][]byte{[]byte("init"), []byte("A"), []byte("100"), []byte("B"), []byte("50")})
+	checkInvoke(t, stub, [][]byte{[]byte("setDeltaWrites"), []byte("B"), []byte("true")})
+
+	// credits to B leave its holding alone and are added on read
+	for i, amount := range []string{"10", "20"} {
+		res := stub.MockInvoke(fmt.Sprint("pay", i), [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte(amount)})
+		if res.Status != shim.OK {
+			fmt.Println("Invoke failed", res.Message)
+			t.FailNow()
+		}
+	}
+	checkState(t, stub, "B", "50")
+	checkQuery(t, stub, "B", "80")
+	checkQuery(t, stub, "A", "70")
+
+	// the history of B misses its deltas
+	checkInvokeFails(t, stub, [][]byte{[]byte("getAccountHistory"), []byte("B")}, "has delta writes")
+	checkInvokeFails(t, stub, [][]byte{[]byte("getAccountStatement"), []byte("B"), []byte("2018-07-01T00:00:00Z"), []byte("2018-08-01T00:00:00Z")}, "has delta writes")
+
+	checkInvokePayload(t, stub, [][]byte{[]byte("compact"), []byte("B")}, `{"name":"B","amount":"80","compacted":2}`)
+	checkState(t, stub, "B", "80")
+	checkInvokePayload(t, stub, [][]byte{[]byte("compact"), []byte("B")}, `{"name":"B","amount":"80","compacted":0}`)
+
+	// a payment from B spends its deltas too
+	stub.MockInvoke("pay2", [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("5")})
+	checkInvoke(t, stub, [][]byte{[]byte("invoke"), []byte("B"), []byte("A"), []byte("85")})
+	checkState(t, stub, "B", "0")
+	checkQuery(t, stub, "A", "150")
+
+	// turning delta writes off compacts, deleting B drops its deltas
+	stub.MockInvoke("pay3", [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("7")})
+	checkInvoke(t, stub, [][]byte{[]byte("setDeltaWrites"), []byte("B"), []byte("false")})
+	checkState(t, stub, "B", "7")
+	checkInvoke(t, stub, [][]byte{[]byte("setDeltaWrites"), []byte("B"), []byte("true")})
+	stub.MockInvoke("pay4", [][]byte{[]byte("invoke"), []byte("A"), []byte("B"), []byte("3")})
+	checkInvoke(t, stub, [][]byte{[]byte("delete"), []byte("B")})
+	for key := range stub.State {
+		if strings.Contains(key, "delta") {
+			fmt.Println("Delete left", key)
+			t.FailNow()
+		}
+	}
+
+	checkInvokeFails(t, stub, [][]byte{[]byte("setDeltaWrites"), []byte("C"), []byte("true")}, "not bound")
+	checkInvokeFails(t, stub, [][]byte{[]byte("setDeltaWrites"), []byte("A"), []byte("maybe")}, "Expecting true or false")
+}
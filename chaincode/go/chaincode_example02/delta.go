@@ -0,0 +1,219 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Every payment reads and writes the holding of its payee, so concurrent payments
+// to one entity fail MVCC validation, all but one per block. An entity with delta
+// writes is credited with a new key per transaction instead, which nothing else
+// reads or writes; getAmount adds the deltas to the holding, and putAmount or
+// compact fold them into it. Debits still read the deltas with a range query, so a
+// payment from the entity conflicts with concurrent credits to it.
+//
+//	deltamode composite key "deltamode" {entity}     present while delta writes are on
+//	delta     composite key "delta" {entity, tx ID}  decimal string, a credit
+//
+// A transaction credits an entity at most once, a second delta would replace the
+// first. The history of the entity only shows the compacted holdings.
+const (
+	deltaModeObjectType = "deltamode"
+	deltaObjectType     = "delta"
+)
+
+// deltaWrites tells whether credits to an entity are delta writes
+func deltaWrites(stub shim.ChaincodeStubInterface, name string) (bool, error) {
+	key, err := stub.CreateCompositeKey(deltaModeObjectType, []string{name})
+	if err != nil {
+		return false, err
+	}
+	modebytes, err := stub.GetState(key)
+	return modebytes != nil, err
+}
+
+// sumDeltas adds up the deltas of an entity and returns their keys
+func sumDeltas(stub shim.ChaincodeStubInterface, name string, scale int) (Amount, []string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(deltaObjectType, []string{name})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resultsIterator.Close()
+
+	var sum Amount
+	var keys []string
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return 0, nil, err
+		}
+		delta, err := ParseAmount(string(kv.Value), scale)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Invalid stored delta for %s: %s", name, err)
+		}
+		sum, err = sum.Add(delta)
+		if err != nil {
+			return 0, nil, err
+		}
+		keys = append(keys, kv.Key)
+	}
+	return sum, keys, nil
+}
+
+// delDeltas removes the deltas of an entity, returns how many there were
+func delDeltas(stub shim.ChaincodeStubInterface, name string, scale int) (int, error) {
+	_, keys, err := sumDeltas(stub, name, scale)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
+
+// delDeltaWrites drops the deltas and the delta writes flag of a deleted entity
+func delDeltaWrites(stub shim.ChaincodeStubInterface, name string, scale int) error {
+	_, err := delDeltas(stub, name, scale)
+	if err != nil {
+		return err
+	}
+	key, err := stub.CreateCompositeKey(deltaModeObjectType, []string{name})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(key)
+}
+
+// creditAmount adds amount to an existing entity, as a delta if it has delta writes
+func creditAmount(stub shim.ChaincodeStubInterface, name string, amount Amount, scale int) error {
+	deltaMode, err := deltaWrites(stub, name)
+	if err != nil {
+		return err
+	}
+	if deltaMode {
+		key, err := stub.CreateCompositeKey(deltaObjectType, []string{name, stub.GetTxID()})
+		if err != nil {
+			return err
+		}
+		return stub.PutState(key, []byte(amount.Format(scale)))
+	}
+
+	val, err := getAmount(stub, name, scale)
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return newCodeError(codeNotFound, "Entity not found: "+name)
+	}
+	*val, err = val.Add(amount)
+	if err != nil {
+		return err
+	}
+	return putAmount(stub, name, *val, scale)
+}
+
+// setDeltaWrites args: name, "true" or "false", the caller must own the entity.
+// Turning delta writes off compacts the deltas.
+func (t *SimpleChaincode) setDeltaWrites(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 2")
+	}
+	on, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return failure(codeArgumentsError, "Expecting true or false")
+	}
+	err = checkOwner(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	scale, err := getScale(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	val, err := getAmount(stub, args[0], scale)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if val == nil {
+		return failure(codeNotFound, "Entity not found: "+args[0])
+	}
+
+	key, err := stub.CreateCompositeKey(deltaModeObjectType, []string{args[0]})
+	if err != nil {
+		return errorResponse(err)
+	}
+	if on {
+		err = stub.PutState(key, []byte{1})
+	} else {
+		err = putAmount(stub, args[0], *val, scale)
+		if err == nil {
+			err = stub.DelState(key)
+		}
+	}
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("Delta writes for %s: %t\n", args[0], on)
+	return success(nil)
+}
+
+// CompactResponse is the data of the Response of compact
+type CompactResponse struct {
+	Name      string `json:"name"`
+	Amount    string `json:"amount"`
+	Compacted int    `json:"compacted"` // number of deltas folded into the holding
+}
+
+// compact args: name. Folds the deltas of an entity into its holding, which does
+// not change, so anyone can compact; meant to be run periodically for entities
+// with delta writes.
+func (t *SimpleChaincode) compact(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 1")
+	}
+	scale, err := getScale(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	val, err := getAmount(stub, args[0], scale)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if val == nil {
+		return failure(codeNotFound, "Entity not found: "+args[0])
+	}
+	compacted, err := delDeltas(stub, args[0], scale)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if compacted > 0 {
+		err = stub.PutState(args[0], []byte(val.Format(scale)))
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	return success(CompactResponse{args[0], val.Format(scale), compacted})
+}
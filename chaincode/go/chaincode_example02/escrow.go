@@ -0,0 +1,324 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/examples/chaincode/go/hashutil"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A hash-time-locked escrow takes an amount out of an entity until either the
+// recipient claims it with the preimage of the hashlock before the deadline, or it
+// is refunded to the payer once the deadline has passed. Times are transaction
+// timestamps, so every endorser decides the same way.
+//
+// The client sets the transaction timestamp and Fabric does not check it, so each
+// endorser rejects timestamps more than maxClockSkew away from its own clock. That
+// only protects a party whose own peers endorse: the endorsement policy must
+// require the orgs of both payer and recipient, or the payer's org alone could
+// backdate a claim out of reach or postdate a refund.
+//
+//	escrow composite key "escrow" {id}               Escrow as JSON, the id is the tx ID of lock
+//	party composite key "escrowparty" {entity, id}   0x00 while the escrow is locked, for from and to
+const (
+	escrowObjectType      = "escrow"
+	escrowPartyObjectType = "escrowparty"
+)
+
+// maxLockSeconds bounds the time funds can be locked for
+const maxLockSeconds = 366 * 24 * 60 * 60
+
+// maxClockSkew is how far a transaction timestamp may be from the endorser's clock
+const maxClockSkew = 5 * time.Minute
+
+// localClock is the endorser's clock, a variable so tests can move it
+var localClock = time.Now
+
+const (
+	escrowLocked   = "locked"
+	escrowClaimed  = "claimed"
+	escrowRefunded = "refunded"
+)
+
+// Escrow is kept once settled, so the revealed preimage can be read
+type Escrow struct {
+	Id       string `json:"id"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Amount   string `json:"amount"`
+	Hashlock string `json:"hashlock"` // lower case hex SHA-256 of the preimage
+	Deadline string `json:"deadline"` // RFC 3339, claims before it, refunds from it on
+	State    string `json:"state"`
+	Preimage string `json:"preimage,omitempty"`
+}
+
+// txTime is the timestamp the client put in the transaction proposal, an error if
+// it is more than maxClockSkew away from the endorser's clock
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if ts == nil {
+		return time.Time{}, errors.New("The transaction has no timestamp")
+	}
+	now := time.Unix(ts.Seconds, int64(ts.Nanos)).UTC()
+	skew := now.Sub(localClock())
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return time.Time{}, newCodeError(codeArgumentsError, fmt.Sprintf("The transaction timestamp %s is more than %s away from the endorser's clock", now.Format(time.RFC3339), maxClockSkew))
+	}
+	return now, nil
+}
+
+// getEscrow returns an error for unknown escrows
+func getEscrow(stub shim.ChaincodeStubInterface, id string) (*Escrow, error) {
+	key, err := stub.CreateCompositeKey(escrowObjectType, []string{id})
+	if err != nil {
+		return nil, err
+	}
+	escrowbytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if escrowbytes == nil {
+		return nil, newCodeError(codeNotFound, "Escrow not found: "+id)
+	}
+	escrow := &Escrow{}
+	err = json.Unmarshal(escrowbytes, escrow)
+	return escrow, err
+}
+
+// putEscrow stores an escrow and keeps its parties indexed while it is locked
+func putEscrow(stub shim.ChaincodeStubInterface, escrow *Escrow) error {
+	key, err := stub.CreateCompositeKey(escrowObjectType, []string{escrow.Id})
+	if err != nil {
+		return err
+	}
+	escrowbytes, err := json.Marshal(escrow)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, escrowbytes)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{escrow.From, escrow.To} {
+		partyKey, err := stub.CreateCompositeKey(escrowPartyObjectType, []string{name, escrow.Id})
+		if err != nil {
+			return err
+		}
+		if escrow.State == escrowLocked {
+			err = stub.PutState(partyKey, []byte{0x00})
+		} else {
+			err = stub.DelState(partyKey)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasLockedEscrow tells whether an entity pays or receives a locked escrow
+func hasLockedEscrow(stub shim.ChaincodeStubInterface, name string) (bool, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(escrowPartyObjectType, []string{name})
+	if err != nil {
+		return false, err
+	}
+	defer resultsIterator.Close()
+	return resultsIterator.HasNext(), nil
+}
+
+// settleEscrow pays a locked escrow out to name and stores its new state
+func settleEscrow(stub shim.ChaincodeStubInterface, escrow *Escrow, name string, state string) pb.Response {
+	scale, err := getScale(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	amount, err := ParseAmount(escrow.Amount, scale)
+	if err != nil {
+		return failure(codeSystemError, fmt.Sprintf("Invalid stored amount for escrow %s: %s", escrow.Id, err))
+	}
+	err = creditAmount(stub, name, amount, scale)
+	if err != nil {
+		return errorResponse(err)
+	}
+	escrow.State = state
+	err = putEscrow(stub, escrow)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("Escrow %s %s, %s to %s\n", escrow.Id, state, escrow.Amount, name)
+	return success(nil)
+}
+
+// lockedEscrow reads an escrow that is still locked and its deadline
+func lockedEscrow(stub shim.ChaincodeStubInterface, id string) (*Escrow, time.Time, error) {
+	escrow, err := getEscrow(stub, id)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if escrow.State != escrowLocked {
+		return nil, time.Time{}, newCodeError(codeInvalidState, "Escrow "+id+" is already "+escrow.State)
+	}
+	deadline, err := time.Parse(time.RFC3339Nano, escrow.Deadline)
+	return escrow, deadline, err
+}
+
+// lock args: from, to, amount, hashlock, seconds. Takes amount out of from, which
+// the caller must own, until to claims it or the deadline, the tx timestamp plus
+// seconds, passes. The hashlock is the SHA-256 of the preimage in hex or base64.
+// Returns the Escrow, its id is needed to claim or refund.
+func (t *SimpleChaincode) lock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 5 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 5")
+	}
+	from, to := args[0], args[1]
+	if from == to {
+		return failure(codeArgumentsError, "Expecting two different entities")
+	}
+	err := checkOwner(stub, from)
+	if err != nil {
+		return errorResponse(err)
+	}
+	hashlock, err := hashutil.NormalizeSHA256(args[3])
+	if err != nil {
+		return failure(codeArgumentsError, "Invalid hashlock, "+err.Error())
+	}
+	seconds, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil || seconds <= 0 || seconds > maxLockSeconds {
+		return failure(codeArgumentsError, fmt.Sprintf("Expecting a lock time from 1 to %d seconds", maxLockSeconds))
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	scale, err := getScale(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	amount, err := ParseAmount(args[2], scale)
+	if err != nil || amount == 0 {
+		return failure(codeArgumentsError, fmt.Sprintf("Invalid transaction amount, expecting a positive amount with at most %d decimals", scale))
+	}
+	toval, err := getAmount(stub, to, scale)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if toval == nil {
+		return failure(codeNotFound, "Entity not found: "+to)
+	}
+	fromval, err := getAmount(stub, from, scale)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if fromval == nil {
+		return failure(codeNotFound, "Entity not found: "+from)
+	}
+	*fromval, err = fromval.Sub(amount)
+	if err == ErrInsufficientFunds {
+		return failure(codeInsufficientFunds, "Insufficient funds: "+from+" holds less than "+amount.Format(scale))
+	}
+
+	escrow := &Escrow{
+		Id:       stub.GetTxID(),
+		From:     from,
+		To:       to,
+		Amount:   amount.Format(scale),
+		Hashlock: hashlock,
+		Deadline: now.Add(time.Duration(seconds) * time.Second).Format(time.RFC3339Nano),
+		State:    escrowLocked,
+	}
+	err = putAmount(stub, from, *fromval, scale)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = putEscrow(stub, escrow)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("Escrow %s locks %s of %s for %s until %s\n", escrow.Id, escrow.Amount, from, to, escrow.Deadline)
+	return success(escrow)
+}
+
+// claim args: id, preimage. Pays the escrow to its recipient before the deadline,
+// anyone who knows the preimage can claim it for the recipient.
+func (t *SimpleChaincode) claim(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 2")
+	}
+	escrow, deadline, err := lockedEscrow(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if !now.Before(deadline) {
+		return failure(codeInvalidState, "Escrow "+escrow.Id+" expired at "+escrow.Deadline)
+	}
+	if hashutil.SHA256Hex(args[1]) != escrow.Hashlock {
+		return failure(codePermissionDenied, "The preimage does not match the hashlock of escrow "+escrow.Id)
+	}
+	escrow.Preimage = args[1]
+	return settleEscrow(stub, escrow, escrow.To, escrowClaimed)
+}
+
+// refund args: id. Returns the escrow to its payer once the deadline has passed,
+// the caller must own the payer.
+func (t *SimpleChaincode) refund(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 1")
+	}
+	escrow, deadline, err := lockedEscrow(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = checkOwner(stub, escrow.From)
+	if err != nil {
+		return errorResponse(err)
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if now.Before(deadline) {
+		return failure(codeInvalidState, "Escrow "+escrow.Id+" can not be refunded before "+escrow.Deadline)
+	}
+	return settleEscrow(stub, escrow, escrow.From, escrowRefunded)
+}
+
+// escrowInfo args: id, returns the Escrow as JSON
+func (t *SimpleChaincode) escrowInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 1")
+	}
+	escrow, err := getEscrow(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	return success(escrow)
+}
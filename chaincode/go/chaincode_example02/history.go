@@ -0,0 +1,222 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Account history and statements read the writes of a balance key with
+// GetHistoryForKey, which needs the history database of the peer
+// (ledger.history.enableHistoryDatabase). An account is an entity of invoke/query,
+// args "A", or a token balance, args "GLD","Org1MSP/alice".
+//
+// An entity with delta writes has its payments in delta keys, not in its balance
+// key, so its history and statements are refused until setDeltaWrites turns them
+// off. The time delta writes were on shows as the compactions that folded them.
+
+// AccountChange is one transaction that wrote an account balance
+type AccountChange struct {
+	TxId      string `json:"txId"`
+	Timestamp string `json:"timestamp"` // RFC 3339, UTC
+	Balance   string `json:"balance"`   // after the transaction
+	Change    string `json:"change"`    // signed, "+10.00" or "-2.50"
+	IsDelete  bool   `json:"isDelete"`
+}
+
+// AccountStatement adds up the changes of an account from From, included, to To, excluded
+type AccountStatement struct {
+	Account        string          `json:"account"`
+	Asset          string          `json:"asset,omitempty"`
+	From           string          `json:"from"`
+	To             string          `json:"to"`
+	OpeningBalance string          `json:"openingBalance"`
+	Credits        string          `json:"credits"`
+	Debits         string          `json:"debits"`
+	ClosingBalance string          `json:"closingBalance"`
+	Changes        []AccountChange `json:"changes"`
+}
+
+type balanceChange struct {
+	txID      string
+	timestamp time.Time
+	balance   Amount
+	credit    Amount
+	debit     Amount
+	isDelete  bool
+}
+
+func (c *balanceChange) accountChange(scale int) AccountChange {
+	change := "+" + c.credit.Format(scale)
+	if c.debit > 0 {
+		change = "-" + c.debit.Format(scale)
+	}
+	return AccountChange{c.txID, c.timestamp.Format(time.RFC3339Nano), c.balance.Format(scale), change, c.isDelete}
+}
+
+// accountKey returns the balance key and scale of the account named by args, and
+// its asset for a token account. Entities with delta writes are refused.
+func accountKey(stub shim.ChaincodeStubInterface, args []string, tokenAccount bool) (string, int, *Asset, error) {
+	if !tokenAccount {
+		deltaMode, err := deltaWrites(stub, args[0])
+		if err != nil {
+			return "", 0, nil, err
+		}
+		if deltaMode {
+			return "", 0, nil, newCodeError(codeInvalidState, "Entity "+args[0]+" has delta writes, its history misses them until setDeltaWrites turns them off")
+		}
+		scale, err := getScale(stub)
+		return args[0], scale, nil, err
+	}
+	asset, err := mustGetAsset(stub, args[0])
+	if err != nil {
+		return "", 0, nil, err
+	}
+	key, err := stub.CreateCompositeKey(balanceObjectType, []string{asset.Symbol, args[1]})
+	return key, asset.Decimals, asset, err
+}
+
+// readBalanceChanges returns the writes of a balance key in commit order. Their
+// timestamps are set by the clients and need not grow with it.
+func readBalanceChanges(stub shim.ChaincodeStubInterface, key string, scale int) ([]balanceChange, error) {
+	resultsIterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var changes []balanceChange
+	for resultsIterator.HasNext() {
+		modification, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		change := balanceChange{txID: modification.TxId, isDelete: modification.IsDelete}
+		if modification.Timestamp != nil {
+			change.timestamp = time.Unix(modification.Timestamp.Seconds, int64(modification.Timestamp.Nanos)).UTC()
+		}
+		if !modification.IsDelete {
+			change.balance, err = ParseAmount(string(modification.Value), scale)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid amount %s in transaction %s", modification.Value, modification.TxId)
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	var previous Amount
+	for i := range changes {
+		if changes[i].balance >= previous {
+			changes[i].credit = changes[i].balance - previous
+		} else {
+			changes[i].debit = previous - changes[i].balance
+		}
+		previous = changes[i].balance
+	}
+	return changes, nil
+}
+
+// getAccountHistory args: "A" or symbol and account, returns the AccountChanges oldest first
+func (t *SimpleChaincode) getAccountHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting an entity or a symbol and an account")
+	}
+	key, scale, _, err := accountKey(stub, args, len(args) == 2)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	changes, err := readBalanceChanges(stub, key, scale)
+	if err != nil {
+		return errorResponse(err)
+	}
+	history := make([]AccountChange, len(changes))
+	for i := range changes {
+		history[i] = changes[i].accountChange(scale)
+	}
+	return success(history)
+}
+
+// getAccountStatement args: "A" or symbol and account, then the window from and to,
+// RFC 3339 times. Returns an AccountStatement. The window is a run of changes in
+// commit order, from the first change at or after from to the last one before the
+// first change at or after to, so a skewed timestamp can not reorder it.
+func (t *SimpleChaincode) getAccountStatement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 && len(args) != 4 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting an entity or a symbol and an account, from and to")
+	}
+	window := args[len(args)-2:]
+	from, err := time.Parse(time.RFC3339, window[0])
+	if err != nil {
+		return failure(codeArgumentsError, "Expecting an RFC 3339 time for from: "+err.Error())
+	}
+	to, err := time.Parse(time.RFC3339, window[1])
+	if err != nil {
+		return failure(codeArgumentsError, "Expecting an RFC 3339 time for to: "+err.Error())
+	}
+	if !from.Before(to) {
+		return failure(codeArgumentsError, "Expecting from before to")
+	}
+	key, scale, asset, err := accountKey(stub, args, len(args) == 4)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	changes, err := readBalanceChanges(stub, key, scale)
+	if err != nil {
+		return errorResponse(err)
+	}
+	var opening, closing, credits, debits Amount
+	statement := AccountStatement{Account: args[len(args)-3], Changes: []AccountChange{}}
+	if asset != nil {
+		statement.Asset = asset.Symbol
+	}
+	started := false
+	for i := range changes {
+		if !started && changes[i].timestamp.Before(from) {
+			opening = changes[i].balance
+			closing = opening
+			continue
+		}
+		if !changes[i].timestamp.Before(to) {
+			break
+		}
+		started = true
+		credits, err = credits.Add(changes[i].credit)
+		if err != nil {
+			return errorResponse(err)
+		}
+		debits, err = debits.Add(changes[i].debit)
+		if err != nil {
+			return errorResponse(err)
+		}
+		closing = changes[i].balance
+		statement.Changes = append(statement.Changes, changes[i].accountChange(scale))
+	}
+	statement.From = from.UTC().Format(time.RFC3339)
+	statement.To = to.UTC().Format(time.RFC3339)
+	statement.OpeningBalance = opening.Format(scale)
+	statement.Credits = credits.Format(scale)
+	statement.Debits = debits.Format(scale)
+	statement.ClosingBalance = closing.Format(scale)
+
+	return success(statement)
+}
@@ -0,0 +1,104 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// enrollmentIDAttribute is added to the certificates issued by a Fabric CA
+const enrollmentIDAttribute = "hf.EnrollmentID"
+
+// clientAccount names the account of the caller "<MSP ID>/<enrollment ID>", e.g.
+// "Org1MSP/user1". The enrollment ID is the hf.EnrollmentID attribute of the
+// certificate, or its subject common name for certificates without attributes.
+// It is a variable so tests can set the caller, MockStub has no creator.
+var clientAccount = func(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", err
+	}
+	enrollmentID, found, err := cid.GetAttributeValue(stub, enrollmentIDAttribute)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		cert, err := cid.GetX509Certificate(stub)
+		if err != nil {
+			return "", err
+		}
+		if cert == nil || cert.Subject.CommonName == "" {
+			return "", errors.New("The client certificate has no enrollment ID nor common name")
+		}
+		enrollmentID = cert.Subject.CommonName
+	}
+	return mspID + "/" + enrollmentID, nil
+}
+
+// Every entity of invoke/query is bound to the client account that owns it, only
+// the owner can pay from it or delete it.
+//
+//	owner composite key "owner" {entity}  client account
+const ownerObjectType = "owner"
+
+// getOwner returns "" for an entity that is not bound to an account
+func getOwner(stub shim.ChaincodeStubInterface, name string) (string, error) {
+	key, err := stub.CreateCompositeKey(ownerObjectType, []string{name})
+	if err != nil {
+		return "", err
+	}
+	ownerbytes, err := stub.GetState(key)
+	return string(ownerbytes), err
+}
+
+func putOwner(stub shim.ChaincodeStubInterface, name string, owner string) error {
+	key, err := stub.CreateCompositeKey(ownerObjectType, []string{name})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, []byte(owner))
+}
+
+func delOwner(stub shim.ChaincodeStubInterface, name string) error {
+	key, err := stub.CreateCompositeKey(ownerObjectType, []string{name})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(key)
+}
+
+// checkOwner returns an error unless the caller owns the entity
+func checkOwner(stub shim.ChaincodeStubInterface, name string) error {
+	owner, err := getOwner(stub, name)
+	if err != nil {
+		return err
+	}
+	if owner == "" {
+		return newCodeError(codePermissionDenied, "Entity "+name+" is not bound to an identity")
+	}
+	caller, err := clientAccount(stub)
+	if err != nil {
+		return err
+	}
+	if caller != owner {
+		return newCodeError(codePermissionDenied, "Entity "+name+" belongs to "+owner+", not to "+caller)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Every response carries a Response as JSON, the codes are those of the demo
+// chaincode's PbResponse plus a few for payments. Unlike the demo, failures keep
+// an error status, 400 or 500 for system errors, so that the peer does not endorse
+// them; their message is the Response too, it is what the peer CLI prints.
+const (
+	codeSuccess           = "1000"
+	codeArgumentsError    = "2000"
+	codeAlreadyExists     = "2010"
+	codeNotFound          = "2020"
+	codePermissionDenied  = "2030"
+	codeInsufficientFunds = "2060"
+	codeInvalidState      = "2070" // e.g. an escrow that is settled or not expired yet
+	codeSystemError       = "9999"
+)
+
+// responseVersion changes with the layout of Response or of its data
+const responseVersion = "1"
+
+// Response is the payload of every function
+type Response struct {
+	Code    string      `json:"code"`
+	Version string      `json:"version"`
+	Data    interface{} `json:"data"`
+	Error   string      `json:"error"`
+}
+
+// codeError is an error with the response code it maps to
+type codeError struct {
+	code    string
+	message string
+}
+
+func (e *codeError) Error() string {
+	return e.message
+}
+
+func newCodeError(code string, message string) error {
+	return &codeError{code, message}
+}
+
+// success returns data, which must marshal to JSON, in a Response
+func success(data interface{}) pb.Response {
+	responsebytes, err := json.Marshal(Response{codeSuccess, responseVersion, data, ""})
+	if err != nil {
+		return failure(codeSystemError, err.Error())
+	}
+	return shim.Success(responsebytes)
+}
+
+func failure(code string, message string) pb.Response {
+	var status int32 = shim.ERRORTHRESHOLD
+	if code == codeSystemError {
+		status = shim.ERROR
+	}
+	responsebytes, err := json.Marshal(Response{code, responseVersion, nil, message})
+	if err != nil {
+		return shim.Error(message)
+	}
+	return pb.Response{Status: status, Message: string(responsebytes), Payload: responsebytes}
+}
+
+// errorResponse maps the code of a codeError or of the Amount errors, anything
+// else is a system error
+func errorResponse(err error) pb.Response {
+	switch err {
+	case ErrInvalidAmount, ErrAmountOverflow:
+		return failure(codeArgumentsError, err.Error())
+	case ErrInsufficientFunds:
+		return failure(codeInsufficientFunds, err.Error())
+	}
+	if e, ok := err.(*codeError); ok {
+		return failure(e.code, e.message)
+	}
+	return failure(codeSystemError, err.Error())
+}
@@ -0,0 +1,359 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The token ledger holds any number of named assets next to the entities of
+// invoke/query. Like ERC-20, an asset is created by its issuer, who alone can mint
+// it, and holders transfer or burn their own balance; accounts are the client
+// identities of clientAccount.
+//
+//	asset   composite key "asset" {symbol}             Asset as JSON
+//	balance composite key "balance" {symbol, account}  decimal string, missing is 0
+//
+// Amounts have the decimals of their asset, see Amount.
+const (
+	assetObjectType   = "asset"
+	balanceObjectType = "balance"
+)
+
+var symbolPattern = regexp.MustCompile("^[A-Za-z0-9]{1,16}$")
+
+// Asset is the metadata of a token
+type Asset struct {
+	Symbol      string `json:"symbol"`
+	Name        string `json:"name"`
+	Decimals    int    `json:"decimals"`
+	Issuer      string `json:"issuer"`
+	TotalSupply string `json:"totalSupply"`
+}
+
+// getAsset returns nil if the asset does not exist
+func getAsset(stub shim.ChaincodeStubInterface, symbol string) (*Asset, error) {
+	key, err := stub.CreateCompositeKey(assetObjectType, []string{symbol})
+	if err != nil {
+		return nil, err
+	}
+	assetbytes, err := stub.GetState(key)
+	if err != nil || assetbytes == nil {
+		return nil, err
+	}
+	asset := &Asset{}
+	err = json.Unmarshal(assetbytes, asset)
+	return asset, err
+}
+
+func putAsset(stub shim.ChaincodeStubInterface, asset *Asset) error {
+	key, err := stub.CreateCompositeKey(assetObjectType, []string{asset.Symbol})
+	if err != nil {
+		return err
+	}
+	assetbytes, err := json.Marshal(asset)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, assetbytes)
+}
+
+// mustGetAsset is getAsset with an error for unknown assets
+func mustGetAsset(stub shim.ChaincodeStubInterface, symbol string) (*Asset, error) {
+	asset, err := getAsset(stub, symbol)
+	if err == nil && asset == nil {
+		err = newCodeError(codeNotFound, "Asset not found: "+symbol)
+	}
+	return asset, err
+}
+
+func getBalance(stub shim.ChaincodeStubInterface, asset *Asset, account string) (Amount, error) {
+	key, err := stub.CreateCompositeKey(balanceObjectType, []string{asset.Symbol, account})
+	if err != nil {
+		return 0, err
+	}
+	balancebytes, err := stub.GetState(key)
+	if err != nil || balancebytes == nil {
+		return 0, err
+	}
+	balance, err := ParseAmount(string(balancebytes), asset.Decimals)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid stored balance of %s for %s: %s", asset.Symbol, account, err)
+	}
+	return balance, nil
+}
+
+// putBalance deletes zero balances, balanceOf reads them as 0 anyway
+func putBalance(stub shim.ChaincodeStubInterface, asset *Asset, account string, balance Amount) error {
+	key, err := stub.CreateCompositeKey(balanceObjectType, []string{asset.Symbol, account})
+	if err != nil {
+		return err
+	}
+	if balance == 0 {
+		return stub.DelState(key)
+	}
+	return stub.PutState(key, []byte(balance.Format(asset.Decimals)))
+}
+
+// addBalance credits an account
+func addBalance(stub shim.ChaincodeStubInterface, asset *Asset, account string, amount Amount) error {
+	balance, err := getBalance(stub, asset, account)
+	if err != nil {
+		return err
+	}
+	balance, err = balance.Add(amount)
+	if err != nil {
+		return err
+	}
+	return putBalance(stub, asset, account, balance)
+}
+
+// subBalance debits an account, ErrInsufficientFunds if it holds less than amount
+func subBalance(stub shim.ChaincodeStubInterface, asset *Asset, account string, amount Amount) error {
+	balance, err := getBalance(stub, asset, account)
+	if err != nil {
+		return err
+	}
+	balance, err = balance.Sub(amount)
+	if err != nil {
+		return err
+	}
+	return putBalance(stub, asset, account, balance)
+}
+
+// moveBalance transfers amount of an asset between two different accounts
+func moveBalance(stub shim.ChaincodeStubInterface, asset *Asset, from string, to string, amount Amount) error {
+	if from == to {
+		return newCodeError(codeArgumentsError, "Expecting two different accounts")
+	}
+	err := subBalance(stub, asset, from, amount)
+	if err != nil {
+		return err
+	}
+	return addBalance(stub, asset, to, amount)
+}
+
+// parseTransferAmount reads a positive amount with the decimals of an asset
+func parseTransferAmount(s string, asset *Asset) (Amount, error) {
+	amount, err := ParseAmount(s, asset.Decimals)
+	if err != nil || amount == 0 {
+		return 0, newCodeError(codeArgumentsError, fmt.Sprintf("Invalid amount, expecting a positive amount with at most %d decimals", asset.Decimals))
+	}
+	return amount, nil
+}
+
+// fundsError names the account that lacks funds
+func fundsError(err error, account string) pb.Response {
+	if err == ErrInsufficientFunds {
+		return failure(codeInsufficientFunds, "Insufficient funds: "+account+" holds less than the amount")
+	}
+	return errorResponse(err)
+}
+
+// createAsset args: symbol, decimals and optionally a name, the caller is the issuer
+func (t *SimpleChaincode) createAsset(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 && len(args) != 3 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 2 or 3")
+	}
+	if !symbolPattern.MatchString(args[0]) {
+		return failure(codeArgumentsError, "Expecting a symbol of 1 to 16 letters and digits")
+	}
+	decimals, err := strconv.Atoi(args[1])
+	if err != nil || decimals < 0 || decimals > MaxScale {
+		return failure(codeArgumentsError, fmt.Sprintf("Expecting decimals from 0 to %d", MaxScale))
+	}
+
+	existing, err := getAsset(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	if existing != nil {
+		return failure(codeAlreadyExists, "Asset already exists: "+args[0])
+	}
+	issuer, err := clientAccount(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	asset := &Asset{Symbol: args[0], Decimals: decimals, Issuer: issuer, TotalSupply: Amount(0).Format(decimals)}
+	if len(args) == 3 {
+		asset.Name = args[2]
+	}
+	err = putAsset(stub, asset)
+	if err != nil {
+		return errorResponse(err)
+	}
+	fmt.Printf("Asset %s created by %s\n", asset.Symbol, issuer)
+	return success(nil)
+}
+
+// assetInfo args: symbol, returns the Asset as JSON
+func (t *SimpleChaincode) assetInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting symbol")
+	}
+	asset, err := mustGetAsset(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	return success(asset)
+}
+
+// mint args: symbol, to, amount, issuer only
+func (t *SimpleChaincode) mint(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 3")
+	}
+	asset, err := mustGetAsset(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	caller, err := clientAccount(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if caller != asset.Issuer {
+		return failure(codePermissionDenied, "Only the issuer "+asset.Issuer+" can mint "+asset.Symbol)
+	}
+	if args[1] == "" {
+		return failure(codeArgumentsError, "Expecting a non-empty account")
+	}
+	amount, err := parseTransferAmount(args[2], asset)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	totalSupply, err := ParseAmount(asset.TotalSupply, asset.Decimals)
+	if err != nil {
+		return errorResponse(err)
+	}
+	totalSupply, err = totalSupply.Add(amount)
+	if err != nil {
+		return errorResponse(err)
+	}
+	asset.TotalSupply = totalSupply.Format(asset.Decimals)
+	err = putAsset(stub, asset)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = addBalance(stub, asset, args[1], amount)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return success(nil)
+}
+
+// burn args: symbol, amount, destroys tokens of the caller
+func (t *SimpleChaincode) burn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 2")
+	}
+	asset, err := mustGetAsset(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	caller, err := clientAccount(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	amount, err := parseTransferAmount(args[1], asset)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	err = subBalance(stub, asset, caller, amount)
+	if err != nil {
+		return fundsError(err, caller)
+	}
+	totalSupply, err := ParseAmount(asset.TotalSupply, asset.Decimals)
+	if err != nil {
+		return errorResponse(err)
+	}
+	totalSupply, err = totalSupply.Sub(amount)
+	if err != nil {
+		return errorResponse(err)
+	}
+	asset.TotalSupply = totalSupply.Format(asset.Decimals)
+	err = putAsset(stub, asset)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return success(nil)
+}
+
+// transfer args: symbol, to, amount, from the caller
+func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 3")
+	}
+	asset, err := mustGetAsset(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	caller, err := clientAccount(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if args[1] == "" {
+		return failure(codeArgumentsError, "Expecting a non-empty account")
+	}
+	amount, err := parseTransferAmount(args[2], asset)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	err = moveBalance(stub, asset, caller, args[1], amount)
+	if err != nil {
+		return fundsError(err, caller)
+	}
+	fmt.Printf("Transfer %s %s from %s to %s\n", amount.Format(asset.Decimals), asset.Symbol, caller, args[1])
+	return success(nil)
+}
+
+// balanceOf args: symbol, account, returns the balance as a decimal string
+func (t *SimpleChaincode) balanceOf(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting 2")
+	}
+	asset, err := mustGetAsset(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	balance, err := getBalance(stub, asset, args[1])
+	if err != nil {
+		return errorResponse(err)
+	}
+	return success(balance.Format(asset.Decimals))
+}
+
+// totalSupply args: symbol, returns the minted minus burnt amount as a decimal string
+func (t *SimpleChaincode) totalSupply(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return failure(codeArgumentsError, "Incorrect number of arguments. Expecting symbol")
+	}
+	asset, err := mustGetAsset(stub, args[0])
+	if err != nil {
+		return errorResponse(err)
+	}
+	return success(asset.TotalSupply)
+}
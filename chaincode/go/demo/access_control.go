@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Admin functions need a caller of an admin MSP (setting adminMspIds) that is an admin
+// of it as well: its identity is listed in setting adminIdentities, or its certificate
+// carries the Fabric CA attribute hf.Type=admin. Any client of the instantiating org
+// is a member of its MSP, the MSP alone is not enough.
+const (
+	ATTR_ENROLLMENT_ID string = "hf.EnrollmentID"
+	ATTR_TYPE          string = "hf.Type"
+	TYPE_ADMIN         string = "admin"
+)
+
+// GetCallerMSPID returns the MSP ID of the client that submitted the transaction
+func GetCallerMSPID(stub shim.ChaincodeStubInterface) (string, error) {
+	return cid.GetMSPID(stub)
+}
+
+// GetCallerIdentity names the client "<MSP ID>/<enrollment ID>", e.g. "Org1MSP/Admin@org1.example.com",
+// like the accounts of example02. The enrollment ID is the hf.EnrollmentID attribute of
+// the certificate, or its subject common name for certificates without attributes.
+// It is a variable so tests can set the caller, MockStub has no creator.
+var GetCallerIdentity = func(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", err
+	}
+	enrollmentID, found, err := cid.GetAttributeValue(stub, ATTR_ENROLLMENT_ID)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		cert, err := cid.GetX509Certificate(stub)
+		if err != nil {
+			return "", err
+		}
+		if cert == nil || cert.Subject.CommonName == "" {
+			return "", errors.New("The client certificate has no enrollment ID nor common name")
+		}
+		enrollmentID = cert.Subject.CommonName
+	}
+	return mspID + "/" + enrollmentID, nil
+}
+
+// GetAdminMSPIDs returns the CFG_ADMIN_MSP_IDS setting of the config store
+func GetAdminMSPIDs(stub shim.ChaincodeStubInterface) ([]string, error) {
+	return GetConfigStrings(stub, CFG_ADMIN_MSP_IDS)
+}
+
+// IsAdmin reports whether the caller is an admin of one of the admin MSPs
+func IsAdmin(stub shim.ChaincodeStubInterface) (bool, error) {
+	mspID, err := GetCallerMSPID(stub)
+	if err != nil {
+		return false, err
+	}
+	mspIDs, err := GetAdminMSPIDs(stub)
+	if err != nil {
+		return false, err
+	}
+	if !containsString(mspIDs, mspID) {
+		return false, nil
+	}
+
+	clientType, found, err := cid.GetAttributeValue(stub, ATTR_TYPE)
+	if err != nil {
+		return false, err
+	} else if found && clientType == TYPE_ADMIN {
+		return true, nil
+	}
+	identity, err := GetCallerIdentity(stub)
+	if err != nil {
+		return false, err
+	}
+	identities, err := GetConfigStrings(stub, CFG_ADMIN_IDENTITIES)
+	if err != nil {
+		return false, err
+	}
+	return containsString(identities, identity), nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -2,13 +2,29 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+// AggregateResult is the Data of a count/aggregate function response
+type AggregateResult struct {
+	Total  int              `json:"total"`
+	Groups []AggregateGroup `json:"groups"`
+}
+
+// AggregateGroup is the count of one group-by value combination
+type AggregateGroup struct {
+	Key   map[string]string `json:"key"`
+	Count int               `json:"count"`
+}
+
 func QueryDocsByIdxkey(stub shim.ChaincodeStubInterface, docType string, idxKey string, idxKeyvalue string) ([]byte, error) {
 	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"%s\",\"%s\":\"%s\"}}", docType, idxKey, idxKeyvalue)
 	return GetQueryResultForQueryString(stub, queryString)
@@ -32,7 +48,7 @@ func QueryDocsByIdxkeys(stub shim.ChaincodeStubInterface, docType string, idxKey
 // =========================================================================================
 func GetQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
 
-	LogMessage("- getQueryResultForQueryString queryString:" + queryString )
+	LogDebug(stub, "start GetQueryResultForQueryString", LogFields{"queryString": queryString})
 
 	resultsIterator, err := stub.GetQueryResult(queryString)
 	if err != nil {
@@ -61,7 +77,7 @@ func GetQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 	}
 	buffer.WriteString("]")
 
-	LogMessage("- getQueryResultForQueryString queryResult:" + buffer.String())
+	LogDebug(stub, "end GetQueryResultForQueryString", LogFields{"queryResult": json.RawMessage(buffer.Bytes())})
 
 	return buffer.Bytes(), nil
 }
@@ -83,7 +99,7 @@ func GetOnlyOneDocByIdxkeys(stub shim.ChaincodeStubInterface, docType string, id
 // =========================================================================================
 func GetOnlyOneForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
 
-	LogMessage("- getQueryResultForQueryString queryString:" + queryString )
+	LogDebug(stub, "start GetOnlyOneForQueryString", LogFields{"queryString": queryString})
 
 	resultsIterator, err := stub.GetQueryResult(queryString)
 	if err != nil {
@@ -110,7 +126,7 @@ func GetOnlyOneForQueryString(stub shim.ChaincodeStubInterface, queryString stri
 	if count == 0 { // not found any doc
 		return nil,nil
 	}else if count == 1{ //find one doc and return
-		LogMessage("- getQueryResultForQueryString queryResult:" + buffer.String())
+		LogDebug(stub, "end GetOnlyOneForQueryString", LogFields{"queryResult": json.RawMessage(buffer.Bytes())})
 		return buffer.Bytes(), nil
 	}else {  // Not the only doc returned.
 		err := errors.New("Not the only doc returned")
@@ -124,7 +140,7 @@ func GetHistoryForDocWithNamespace(stub shim.ChaincodeStubInterface, ns string,
 		return nil, errors.New("docKey should not be empty")
 	}
 
-	LogMessage("- start getHistoryForDocWithNamespace:" + docKey)
+	LogDebug(stub, "start GetHistoryForDocWithNamespace", LogFields{"docKey": ns + docKey})
 
 	resultsIterator, err := stub.GetHistoryForKey(ns + docKey)
 	if err != nil {
@@ -176,7 +192,7 @@ func GetHistoryForDocWithNamespace(stub shim.ChaincodeStubInterface, ns string,
 	}
 	buffer.WriteString("]")
 
-	fmt.Printf("- getHistoryForDocWithNamespace returning:\n%s\n", buffer.String())
+	LogDebug(stub, "end GetHistoryForDocWithNamespace", LogFields{"history": json.RawMessage(buffer.Bytes())})
 
 	return buffer.Bytes(), nil
 }
@@ -220,3 +236,153 @@ func CreateCKeyWithNamespace(stub shim.ChaincodeStubInterface, ns string, idxNam
 func CreateCKey(stub shim.ChaincodeStubInterface, idxName string, idxPair []string) error {
 	return CreateCKeyWithNamespace(stub, "", idxName, idxPair)
 }
+
+func DeleteCKeyWithNamespace(stub shim.ChaincodeStubInterface, ns string, idxName string, idxPair []string) error {
+	compositeKey, err := stub.CreateCompositeKey(ns+idxName, idxPair)
+	if err != nil {
+		return err
+	}
+	return stub.DelState(compositeKey)
+}
+
+func DeleteCKey(stub shim.ChaincodeStubInterface, idxName string, idxPair []string) error {
+	return DeleteCKeyWithNamespace(stub, "", idxName, idxPair)
+}
+
+// =========================================================================================
+// CountCKeysWithNamespace range scans the composite keys of an index that start with
+// partialKey and counts them, grouped by the attributes at the groupBy positions.
+// Only the keys are read, so no document is loaded.
+// =========================================================================================
+func CountCKeysWithNamespace(stub shim.ChaincodeStubInterface, ns string, idxName string, partialKey []string, groupBy []string, groupByIdx []int) (*AggregateResult, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(ns+idxName, partialKey)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	aggregator := newAggregator(groupBy)
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attributes, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		values := make([]string, len(groupByIdx))
+		for i, idx := range groupByIdx {
+			if idx >= len(attributes) {
+				return nil, errors.New("Index " + idxName + " has no attribute at position " + strconv.Itoa(idx))
+			}
+			values[i] = attributes[idx]
+		}
+		aggregator.add(values)
+	}
+
+	return aggregator.result(), nil
+}
+
+// =========================================================================================
+// CountDocsWithNamespace range scans every doc stored under the namespace and counts the
+// ones whose fields equal the selector values, grouped by the groupBy fields. Docs are
+// upcast to the code schema version of docType first.
+// Use CountCKeysWithNamespace instead whenever an index covers the selector.
+// =========================================================================================
+func CountDocsWithNamespace(stub shim.ChaincodeStubInterface, ns string, docType string, selector map[string]string, groupBy []string) (*AggregateResult, error) {
+	resultsIterator, err := stub.GetStateByRange(ns, ns+string(utf8.MaxRune))
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	aggregator := newAggregator(groupBy)
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		doc, err := unmarshalFields(queryResponse.Value)
+		if err != nil {
+			return nil, errors.New("Failed to unmarshal doc " + queryResponse.Key + ": " + err.Error())
+		}
+		_, err = UpcastDoc(docType, doc)
+		if err != nil {
+			return nil, err
+		}
+
+		matched := true
+		for field, value := range selector {
+			if docFieldString(doc, field) != value {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		values := make([]string, len(groupBy))
+		for i, field := range groupBy {
+			values[i] = docFieldString(doc, field)
+		}
+		aggregator.add(values)
+	}
+
+	return aggregator.result(), nil
+}
+
+func docFieldString(doc map[string]interface{}, field string) string {
+	value, ok := doc[field]
+	if !ok || value == nil {
+		return ""
+	}
+	if str, ok := value.(string); ok {
+		return str
+	}
+	return fmt.Sprint(value)
+}
+
+type aggregator struct {
+	groupBy []string
+	total   int
+	counts  map[string]int
+	keys    map[string][]string
+}
+
+func newAggregator(groupBy []string) *aggregator {
+	return &aggregator{groupBy: groupBy, counts: make(map[string]int), keys: make(map[string][]string)}
+}
+
+func (a *aggregator) add(values []string) {
+	// 0x00 can not appear in a composite key attribute, so it is a safe separator
+	groupKey := strings.Join(values, "\x00")
+	a.counts[groupKey]++
+	a.keys[groupKey] = values
+	a.total++
+}
+
+// result returns the groups in a deterministic order so every endorser builds the same payload
+func (a *aggregator) result() *AggregateResult {
+	groupKeys := make([]string, 0, len(a.counts))
+	for groupKey := range a.counts {
+		groupKeys = append(groupKeys, groupKey)
+	}
+	sort.Strings(groupKeys)
+
+	result := &AggregateResult{Total: a.total, Groups: []AggregateGroup{}}
+	if len(a.groupBy) == 0 {
+		return result
+	}
+	for _, groupKey := range groupKeys {
+		key := make(map[string]string)
+		for i, field := range a.groupBy {
+			key[field] = a.keys[groupKey][i]
+		}
+		result.Groups = append(result.Groups, AggregateGroup{key, a.counts[groupKey]})
+	}
+	return result
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"sort"
+	"strconv"
+)
+
+// The chaincode settings are one JSON doc under KEY_CONFIG, so GetHistoryForKey on it
+// is the change history. Keys starting with NS_RESERVED belong to the chaincode itself
+// and can not be used as a docType (see NewDocRepository).
+//
+// Every setting is registered in configSettings with its default, whose Go type
+// (string, int, bool or []string) is the type of the setting. Unset settings read as
+// their default.
+const (
+	NS_RESERVED string = "demo_"
+	KEY_CONFIG  string = NS_RESERVED + "config"
+
+	CFG_ADMIN_MSP_IDS         string = "adminMspIds"         // MSP IDs allowed to run admin functions
+	CFG_ADMIN_IDENTITIES      string = "adminIdentities"     // "<MSP ID>/<enrollment ID>" of their admins, see access_control.go
+	CFG_QUERY_BACKEND         string = "queryBackend"        // how QueryXxxByStatus reads: couchdb or index
+	CFG_MAX_BATCH_SIZE        string = "maxBatchSize"        // max items of a batch function
+	CFG_MIGRATION_BATCH_SIZE  string = "migrationBatchSize"  // docs rewritten per migration transaction
+	CFG_LOG_LEVEL             string = "logLevel"            // debug, info, warning or error, empty falls back to env DEMO_LOG_LEVEL
+	CFG_REQUEST_AUTH          string = "requestAuth"         // off, optional or required, see request_auth.go
+	CFG_NONCE_TTL             string = "nonceTtl"            // seconds a signed request is valid, see nonce_registry.go
+	CFG_ENCRYPTED_USER_FIELDS string = "encryptedUserFields" // UserInfo fields stored encrypted, see field_encryption.go
+	CFG_LEDGER_CHAINCODE      string = "ledgerChaincode"     // name of the example02 chaincode holding user balances, empty for none, see ledger_client.go
+	CFG_LEDGER_CHANNEL        string = "ledgerChannel"       // channel of the ledger chaincode, empty for this channel
+
+	QUERY_BACKEND_COUCHDB string = "couchdb" // rich query, needs CouchDB as state database
+	QUERY_BACKEND_INDEX   string = "index"   // composite key index scan, works on LevelDB too
+)
+
+type configSetting struct {
+	Default  interface{}
+	Validate func(value interface{}) error
+}
+
+var configSettings = map[string]configSetting{
+	CFG_ADMIN_MSP_IDS:         {[]string{}, nil},
+	CFG_ADMIN_IDENTITIES:      {[]string{}, nil},
+	CFG_QUERY_BACKEND:         {QUERY_BACKEND_COUCHDB, oneOf(QUERY_BACKEND_COUCHDB, QUERY_BACKEND_INDEX)},
+	CFG_MAX_BATCH_SIZE:        {MAX_BATCH_SIZE, positive},
+	CFG_MIGRATION_BATCH_SIZE:  {MIGRATION_BATCH_SIZE, positive},
+	CFG_LOG_LEVEL:             {"", oneOf("", LOG_LEVEL_DEBUG, LOG_LEVEL_INFO, LOG_LEVEL_WARNING, LOG_LEVEL_ERROR)},
+	CFG_REQUEST_AUTH:          {REQUEST_AUTH_OFF, oneOf(REQUEST_AUTH_OFF, REQUEST_AUTH_OPTIONAL, REQUEST_AUTH_REQUIRED)},
+	CFG_NONCE_TTL:             {NONCE_TTL, positive},
+	CFG_ENCRYPTED_USER_FIELDS: {[]string{}, subsetOf(userInfoEncryptableFields...)},
+	CFG_LEDGER_CHAINCODE:      {"", nil},
+	CFG_LEDGER_CHANNEL:        {"", nil},
+}
+
+// ConfigDoc is stored under KEY_CONFIG
+type ConfigDoc struct {
+	Settings  map[string]interface{} `json:"settings"`
+	UpdatedBy string                 `json:"updatedBy"`
+	TxId      string                 `json:"txId"`
+}
+
+func oneOf(values ...string) func(value interface{}) error {
+	return func(value interface{}) error {
+		for _, v := range values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %v", values)
+	}
+}
+
+func subsetOf(values ...string) func(value interface{}) error {
+	return func(value interface{}) error {
+		for _, v := range value.([]string) {
+			if err := oneOf(values...)(v); err != nil {
+				return fmt.Errorf("items must be one of %v", values)
+			}
+		}
+		return nil
+	}
+}
+
+func positive(value interface{}) error {
+	if value.(int) <= 0 {
+		return errors.New("must be a positive integer")
+	}
+	return nil
+}
+
+// ParseConfigSettings reads a JSON object of settings, a null value resets a setting to its default
+func ParseConfigSettings(settingsJSON string) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(settingsJSON)))
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	err := decoder.Decode(&raw)
+	if err != nil {
+		return nil, errors.New("settings must be a JSON object: " + err.Error())
+	}
+
+	settings := make(map[string]interface{})
+	for name, value := range raw {
+		if value == nil {
+			settings[name] = nil
+			continue
+		}
+		settings[name], err = normalizeConfigValue(name, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// normalizeConfigValue converts a decoded JSON value to the type of the setting and validates it
+func normalizeConfigValue(name string, value interface{}) (interface{}, error) {
+	setting, ok := configSettings[name]
+	if !ok {
+		return nil, errors.New("unknown setting " + name)
+	}
+
+	var normalized interface{}
+	var err error
+	switch setting.Default.(type) {
+	case string:
+		str, ok := value.(string)
+		if !ok {
+			err = errors.New("must be a string")
+		}
+		normalized = str
+	case bool:
+		b, ok := value.(bool)
+		if !ok {
+			err = errors.New("must be a boolean")
+		}
+		normalized = b
+	case int:
+		var i int
+		i, err = strconv.Atoi(fmt.Sprint(value))
+		if err != nil {
+			err = errors.New("must be an integer")
+		}
+		normalized = i
+	case []string:
+		values, ok := value.([]interface{})
+		strs := make([]string, 0, len(values))
+		for _, v := range values {
+			str, isString := v.(string)
+			ok = ok && isString
+			strs = append(strs, str)
+		}
+		if !ok {
+			err = errors.New("must be an array of strings")
+		}
+		normalized = strs
+	}
+	if err == nil && setting.Validate != nil {
+		err = setting.Validate(normalized)
+	}
+	if err != nil {
+		return nil, errors.New("setting " + name + " " + err.Error())
+	}
+	return normalized, nil
+}
+
+func getConfigDoc(stub shim.ChaincodeStubInterface) (*ConfigDoc, error) {
+	configDoc := &ConfigDoc{Settings: make(map[string]interface{})}
+	valAsbytes, err := stub.GetState(KEY_CONFIG)
+	if err != nil || valAsbytes == nil {
+		return configDoc, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(valAsbytes))
+	decoder.UseNumber()
+	err = decoder.Decode(configDoc)
+	if err != nil {
+		return nil, errors.New("Malformed " + KEY_CONFIG + ": " + err.Error())
+	}
+	for name, value := range configDoc.Settings {
+		if _, ok := configSettings[name]; !ok {
+			// a setting of a newer chaincode version, kept as is
+			continue
+		}
+		configDoc.Settings[name], err = normalizeConfigValue(name, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	level, _ := configDoc.Settings[CFG_LOG_LEVEL].(string)
+	setConfigLogLevel(level)
+	return configDoc, nil
+}
+
+// GetConfig returns every registered setting, stored value or default
+func GetConfig(stub shim.ChaincodeStubInterface) (map[string]interface{}, error) {
+	configDoc, err := getConfigDoc(stub)
+	if err != nil {
+		return nil, err
+	}
+	config := make(map[string]interface{})
+	for name, setting := range configSettings {
+		config[name] = setting.Default
+		if value, ok := configDoc.Settings[name]; ok {
+			config[name] = value
+		}
+	}
+	return config, nil
+}
+
+func getConfigValue(stub shim.ChaincodeStubInterface, name string) (interface{}, error) {
+	setting, ok := configSettings[name]
+	if !ok {
+		return nil, errors.New("unknown setting " + name)
+	}
+	configDoc, err := getConfigDoc(stub)
+	if err != nil {
+		return nil, err
+	}
+	if value, ok := configDoc.Settings[name]; ok {
+		return value, nil
+	}
+	return setting.Default, nil
+}
+
+func GetConfigString(stub shim.ChaincodeStubInterface, name string) (string, error) {
+	value, err := getConfigValue(stub, name)
+	if err != nil {
+		return "", err
+	}
+	str, ok := value.(string)
+	if !ok {
+		return "", errors.New("setting " + name + " is not a string")
+	}
+	return str, nil
+}
+
+func GetConfigInt(stub shim.ChaincodeStubInterface, name string) (int, error) {
+	value, err := getConfigValue(stub, name)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := value.(int)
+	if !ok {
+		return 0, errors.New("setting " + name + " is not an integer")
+	}
+	return i, nil
+}
+
+func GetConfigBool(stub shim.ChaincodeStubInterface, name string) (bool, error) {
+	value, err := getConfigValue(stub, name)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, errors.New("setting " + name + " is not a boolean")
+	}
+	return b, nil
+}
+
+func GetConfigStrings(stub shim.ChaincodeStubInterface, name string) ([]string, error) {
+	value, err := getConfigValue(stub, name)
+	if err != nil {
+		return nil, err
+	}
+	strs, ok := value.([]string)
+	if !ok {
+		return nil, errors.New("setting " + name + " is not an array of strings")
+	}
+	return strs, nil
+}
+
+// =========================================================================================
+// PutConfigSettings merges settings from ParseConfigSettings into the stored config.
+// With overwrite false, settings that are already stored are left alone (used to seed).
+// Returns the names of the settings that changed.
+// =========================================================================================
+func PutConfigSettings(stub shim.ChaincodeStubInterface, settings map[string]interface{}, overwrite bool, updatedBy string) ([]string, error) {
+	configDoc, err := getConfigDoc(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var changed []string
+	for _, name := range names {
+		oldValue, stored := configDoc.Settings[name]
+		if stored && !overwrite {
+			continue
+		}
+		if settings[name] == nil {
+			if stored {
+				delete(configDoc.Settings, name)
+				changed = append(changed, name)
+			}
+			continue
+		}
+		if stored && fmt.Sprint(oldValue) == fmt.Sprint(settings[name]) {
+			continue
+		}
+		configDoc.Settings[name] = settings[name]
+		changed = append(changed, name)
+	}
+
+	if len(changed) == 0 {
+		return changed, nil
+	}
+
+	configDoc.UpdatedBy = updatedBy
+	configDoc.TxId = stub.GetTxID()
+	configDocAsBytes, err := json.Marshal(configDoc)
+	if err != nil {
+		return nil, err
+	}
+	return changed, stub.PutState(KEY_CONFIG, configDocAsBytes)
+}
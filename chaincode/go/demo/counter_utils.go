@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"sort"
+	"strconv"
+)
+
+// A counter is a base value plus any number of delta keys. Every transaction
+// writes its own delta key (the txID is part of the key), so concurrent
+// transactions updating the same counter never touch the same key and never
+// fail MVCC validation. Reads sum base and deltas, compaction folds the deltas
+// back into the base.
+//
+//  base  key: counter      {group} {member}
+//  delta key: counterDelta {group} {member} {txID}
+const (
+	DT_COUNTER       string = "counter"
+	DT_COUNTER_DELTA string = "counterDelta"
+)
+
+// CounterDeltas accumulates the changes of one transaction to the counters of a group.
+// Call Flush once at the end of the transaction.
+type CounterDeltas struct {
+	group  string
+	deltas map[string]int64
+}
+
+func NewCounterDeltas(group string) *CounterDeltas {
+	return &CounterDeltas{group, make(map[string]int64)}
+}
+
+func (c *CounterDeltas) Add(member string, delta int64) {
+	c.deltas[member] += delta
+}
+
+// Flush writes one delta key per changed member, in a deterministic order
+func (c *CounterDeltas) Flush(stub shim.ChaincodeStubInterface) error {
+	members := make([]string, 0, len(c.deltas))
+	for member, delta := range c.deltas {
+		if delta != 0 {
+			members = append(members, member)
+		}
+	}
+	sort.Strings(members)
+
+	for _, member := range members {
+		deltaKey, err := stub.CreateCompositeKey(DT_COUNTER_DELTA, []string{c.group, member, stub.GetTxID()})
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(deltaKey, []byte(strconv.FormatInt(c.deltas[member], 10)))
+		if err != nil {
+			return err
+		}
+	}
+	c.deltas = make(map[string]int64)
+	return nil
+}
+
+// =========================================================================================
+// GetCounters returns the value of every member of a counter group: base + sum of deltas
+// =========================================================================================
+func GetCounters(stub shim.ChaincodeStubInterface, group string) (map[string]int64, error) {
+	counters := make(map[string]int64)
+	for _, docType := range []string{DT_COUNTER, DT_COUNTER_DELTA} {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(docType, []string{group})
+		if err != nil {
+			return nil, err
+		}
+
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			member, value, err := parseCounterKV(stub, queryResponse.Key, queryResponse.Value)
+			if err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			counters[member] += value
+		}
+		resultsIterator.Close()
+	}
+	return counters, nil
+}
+
+// =========================================================================================
+// CompactCounters folds at most maxDeltas delta keys of a group into the base keys and
+// deletes them. maxDeltas <= 0 compacts every delta. Returns the number of deltas folded.
+// Deltas written while compaction runs make it fail validation (phantom read), never the writers.
+// =========================================================================================
+func CompactCounters(stub shim.ChaincodeStubInterface, group string, maxDeltas int) (int, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(DT_COUNTER_DELTA, []string{group})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	sums := make(map[string]int64)
+	var deltaKeys []string
+	for resultsIterator.HasNext() {
+		if maxDeltas > 0 && len(deltaKeys) >= maxDeltas {
+			break
+		}
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		member, value, err := parseCounterKV(stub, queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return 0, err
+		}
+		sums[member] += value
+		deltaKeys = append(deltaKeys, queryResponse.Key)
+	}
+
+	members := make([]string, 0, len(sums))
+	for member := range sums {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+
+	for _, member := range members {
+		base, err := getCounterBase(stub, group, member)
+		if err != nil {
+			return 0, err
+		}
+		err = putCounterBase(stub, group, member, base+sums[member])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, deltaKey := range deltaKeys {
+		err = stub.DelState(deltaKey)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(deltaKeys), nil
+}
+
+// =========================================================================================
+// ResetCounters sets the base keys of a group to values and drops every delta of the group.
+// Used to seed counters from data written before the counters existed.
+// =========================================================================================
+func ResetCounters(stub shim.ChaincodeStubInterface, group string, values map[string]int64) error {
+	for _, docType := range []string{DT_COUNTER, DT_COUNTER_DELTA} {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(docType, []string{group})
+		if err != nil {
+			return err
+		}
+		var keys []string
+		for resultsIterator.HasNext() {
+			queryResponse, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return err
+			}
+			keys = append(keys, queryResponse.Key)
+		}
+		resultsIterator.Close()
+
+		for _, key := range keys {
+			err = stub.DelState(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	members := make([]string, 0, len(values))
+	for member := range values {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	for _, member := range members {
+		err := putCounterBase(stub, group, member, values[member])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getCounterBase(stub shim.ChaincodeStubInterface, group string, member string) (int64, error) {
+	baseKey, err := stub.CreateCompositeKey(DT_COUNTER, []string{group, member})
+	if err != nil {
+		return 0, err
+	}
+	valAsbytes, err := stub.GetState(baseKey)
+	if err != nil || valAsbytes == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(valAsbytes), 10, 64)
+}
+
+func putCounterBase(stub shim.ChaincodeStubInterface, group string, member string, value int64) error {
+	baseKey, err := stub.CreateCompositeKey(DT_COUNTER, []string{group, member})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(baseKey, []byte(strconv.FormatInt(value, 10)))
+}
+
+func parseCounterKV(stub shim.ChaincodeStubInterface, key string, value []byte) (string, int64, error) {
+	_, attributes, err := stub.SplitCompositeKey(key)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(attributes) < 2 {
+		return "", 0, errors.New("Malformed counter key: " + key)
+	}
+	parsed, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return "", 0, errors.New("Malformed counter value for " + key + ": " + err.Error())
+	}
+	return attributes[1], parsed, nil
+}
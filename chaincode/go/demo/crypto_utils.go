@@ -1,10 +1,20 @@
 package main
 
 import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
 )
 
 // ==== In cryptography, a keyed-hash message authentication code (HMAC)
@@ -30,6 +40,124 @@ func CheckMAC(message string, messageMAC string, secret string) bool {
 
 	return hmac.Equal(checkBytes, expectedMACBytes)
 }
+
+// ==== ParsePublicKeyPEM reads a public key from a PEM "PUBLIC KEY" (PKIX)
+// ==== or from the X.509 "CERTIFICATE" it belongs to
+func ParsePublicKeyPEM(publicKeyPEM string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, errors.New("public key is not PEM encoded")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return certificate.PublicKey, nil
+	}
+	return nil, errors.New("unsupported PEM block " + block.Type + ", expecting PUBLIC KEY or CERTIFICATE")
+}
+
+func ParseCertificatePEM(certificatePEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certificatePEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("certificate is not PEM encoded")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func ParseECDSAP256PublicKey(publicKeyPEM string) (*ecdsa.PublicKey, error) {
+	publicKey, err := ParsePublicKeyPEM(publicKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaPublicKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok || ecdsaPublicKey.Curve != elliptic.P256() {
+		return nil, errors.New("public key is not an ECDSA P-256 key")
+	}
+	return ecdsaPublicKey, nil
+}
+
+// ==== VerifyECDSASignature checks a base64 ASN.1 DER ECDSA signature of the SHA-256 of message
+// ==== against a P-256 public key or certificate in PEM
+func VerifyECDSASignature(publicKeyPEM string, message string, signatureBase64 string) (bool, error) {
+	ecdsaPublicKey, err := ParseECDSAP256PublicKey(publicKeyPEM)
+	if err != nil {
+		return false, err
+	}
+	return verifyECDSA(ecdsaPublicKey, message, signatureBase64), nil
+}
+
+func verifyECDSA(publicKey *ecdsa.PublicKey, message string, signatureBase64 string) bool {
+	signature, err := Base64Decoding(signatureBase64)
+	if err != nil {
+		return false
+	}
+	var rs struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(signature, &rs)
+	if err != nil || len(rest) != 0 || rs.R == nil || rs.S == nil {
+		return false
+	}
+	return ecdsa.Verify(publicKey, ComputeSHA256Bytes(message), rs.R, rs.S)
+}
+
+// ==== VerifySignature checks a signature with the key, ECDSA P-256 is the only algorithm:
+// ==== Ed25519 needs Go 1.13, the fabric-ccenv images of Fabric 1.1 build with Go 1.9
+func VerifySignature(publicKeyPEM string, message string, signatureBase64 string) (bool, error) {
+	publicKey, err := ParsePublicKeyPEM(publicKeyPEM)
+	if err != nil {
+		return false, err
+	}
+	if key, ok := publicKey.(*ecdsa.PublicKey); ok && key.Curve == elliptic.P256() {
+		return verifyECDSA(key, message, signatureBase64), nil
+	}
+	return false, errors.New("public key is not ECDSA P-256")
+}
+
+// ==== EncryptAESGCM seals plaintext with AES-GCM, key of 16, 24 or 32 bytes, nonce of 12 bytes.
+// ==== A nonce must never be used twice with the same key for different plaintexts.
+func EncryptAESGCM(key []byte, nonce []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newAESGCM(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+func DecryptAESGCM(key []byte, nonce []byte, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newAESGCM(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newAESGCM(key []byte, nonce []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("nonce must be %d bytes", aead.NonceSize())
+	}
+	return aead, nil
+}
+
+func ComputeHmac256Bytes(message []byte, key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(message)
+	return h.Sum(nil)
+}
+
 func ComputeSHA256Bytes(message string) []byte {
 	h := sha256.New()
 	h.Write([]byte(message))
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 	"strconv"
@@ -19,31 +20,111 @@ const (
 	RESP_CODE_ARGUMENTS_ERROR              string = "2000"   // 2000-参数错误
 	RESP_CODE_DATA_ALREADY_EXIST           string = "2010"   // 2001-数据已经存在
 	RESP_CODE_DATA_NOT_EXISTED             string = "2020"   // 2011-数据不存在
+	RESP_CODE_PERMISSION_DENIED            string = "2030"   // 2030-无权限
+	RESP_CODE_UNAUTHENTICATED              string = "2040"   // 2040-请求签名校验失败
+	RESP_CODE_NONCE_USED                   string = "2050"   // 2050-重复请求(nonce已使用)
+	RESP_CODE_INSUFFICIENT_FUNDS           string = "2060"   // 2060-余额不足, example02
+	RESP_CODE_INVALID_STATE                string = "2070"   // 2070-状态不允许, example02
+	RESP_CODE_BALANCE_NOT_ZERO             string = "2080"   // 2080-账户余额不为零
 	RESP_CODE_SYSTEM_ERROR                 string = "9999"   // 系统错误
 )
 
+const (
+	CC_VERSION      string = "1.1"        // version of this chaincode, recorded by every init/reset
+	DEMO_UI_VERSION string = "1.0"        // compatible demo application version
+	KEY_DEMO_UI     string = "demo_ui"
+	KEY_SELFTEST    string = "selftest"
+	KEY_INIT_RECORD string = "demo_init"  // who ran the last init/reset, with which version and mode
+
+	INIT_MODE_KEEP    string = "keep"     // default, only write what does not exist yet
+	INIT_MODE_MIGRATE string = "migrate"  // overwrite selftest and demo_ui with the new values, start pending schema migrations
+)
+
+// InitRecord is stored under KEY_INIT_RECORD by every init/reset
+type InitRecord struct {
+	CcVersion string `json:"ccVersion"`
+	DemoUi    string `json:"demoUi"`
+	Mode      string `json:"mode"`
+	Reset     bool   `json:"reset"`
+	MspId     string `json:"mspId"`
+	TxId      string `json:"txId"`
+	Timestamp int64  `json:"timestamp"`
+}
+
 type DomoChaincode struct {
 	UserMng *UserMng
 }
 
+// Router handles the functions of one module. Generated managers (see entitygen)
+// register themselves in init(), Invoke asks them after its own functions.
+type Router interface {
+	Route(stub shim.ChaincodeStubInterface, function string, args []string) (pb.Response, bool)
+}
+
+var routers []Router
+
+func RegisterRouter(router Router) {
+	routers = append(routers, router)
+}
+
 func main() {
 	err := shim.Start(new(DomoChaincode))
 	if err != nil {
-		LogMessage("Error starting Simple chaincode:" + err.Error())
+		LogError(nil, "Error starting Simple chaincode", LogFields{"error": err})
 	}
 }
 
 /**
- * Init initializes chaincode
+ * Init initializes chaincode, called on instantiate and upgrade
+ *
+ * Inputs - Array of strings
+ *  0           1                       2
+ *  selftest    mode, optional          settings, optional, see config_store.go
+ *  "100"       "keep" | "migrate"      "{\"queryBackend\":\"index\"}"
+ *
+ * Settings are seeded: in mode keep only those not stored yet are written.
  */
 func (t *DomoChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
-	LogMessage("demo chaincode Is Starting Up")
+	LogInfo(stub, "demo chaincode Is Starting Up")
 	_, args := stub.GetFunctionAndParameters()
+
+	mspID, err := GetCallerMSPID(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get caller MSP ID: " + err.Error())
+	}
+
+	response := t.initState(stub, args, mspID, false)
+	LogResponse(stub, response)
+	return response
+}
+
+// ============================================================================================================================
+// Reset - run Init from an invocation, admin only
+//
+// Same arguments as Init. Existing data is kept unless mode "migrate" is passed,
+// so running it twice with the same arguments changes nothing but the init record.
+// ============================================================================================================================
+func (t *DomoChaincode) Reset(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	mspID, err := GetCallerMSPID(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get caller MSP ID: " + err.Error())
+	}
+	isAdmin, err := IsAdmin(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if !isAdmin {
+		return ErrorPbResponse(RESP_CODE_PERMISSION_DENIED, "Only admins may reset the chaincode, not " + mspID)
+	}
+
+	return t.initState(stub, args, mspID, true)
+}
+
+func (t *DomoChaincode) initState(stub shim.ChaincodeStubInterface, args []string, mspID string, reset bool) pb.Response {
 	var Aval int
 	var err error
 
-	if len(args) != 1 {
-		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 1")
+	if len(args) < 1 || len(args) > 3 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 1 to 3")
 	}
 
 	// convert numeric string to integer
@@ -52,52 +133,197 @@ func (t *DomoChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Expecting a numeric string argument to Init()")
 	}
 
+	mode := INIT_MODE_KEEP
+	if len(args) >= 2 {
+		mode = args[1]
+	}
+	if mode != INIT_MODE_KEEP && mode != INIT_MODE_MIGRATE {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "2nd argument must be " + INIT_MODE_KEEP + " or " + INIT_MODE_MIGRATE)
+	}
+
+	settings := make(map[string]interface{})
+	if len(args) == 3 {
+		settings, err = ParseConfigSettings(args[2])
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "3rd argument: " + err.Error())
+		}
+	}
+
+	// whoever instantiates the chaincode becomes its first admin
+	if _, ok := settings[CFG_ADMIN_MSP_IDS]; !ok && !reset {
+		adminMSPIDs, err := GetAdminMSPIDs(stub)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+		if len(adminMSPIDs) == 0 {
+			settings[CFG_ADMIN_MSP_IDS] = []string{mspID}
+		}
+	}
+	if _, ok := settings[CFG_ADMIN_IDENTITIES]; !ok && !reset {
+		adminIdentities, err := GetConfigStrings(stub, CFG_ADMIN_IDENTITIES)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+		if len(adminIdentities) == 0 {
+			identity, err := GetCallerIdentity(stub)
+			if err != nil {
+				return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get caller identity: " + err.Error())
+			}
+			settings[CFG_ADMIN_IDENTITIES] = []string{identity}
+		}
+	}
+
+	_, err = PutConfigSettings(stub, settings, mode == INIT_MODE_MIGRATE, mspID)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
 	// store compaitible demo application version
-	err = stub.PutState("demo_ui", []byte("1.0"))
+	err = putStateUnlessKept(stub, KEY_DEMO_UI, []byte(DEMO_UI_VERSION), mode)
 	if err != nil {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
 	}
 
 	// this is a very simple dumb test.  let's write to the ledger and error on any errors
 	//making a test var "selftest", its handy to read this right away to test the network
-	err = stub.PutState("selftest", []byte(strconv.Itoa(Aval)))
+	err = putStateUnlessKept(stub, KEY_SELFTEST, []byte(strconv.Itoa(Aval)), mode)
 	if err != nil {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error()) //self-test fail
 	}
 
+	// record the version that ran this init
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	demoUi, err := stub.GetState(KEY_DEMO_UI)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	if mode == INIT_MODE_MIGRATE || demoUi == nil {
+		demoUi = []byte(DEMO_UI_VERSION)
+	}
+	initRecord := InitRecord{CC_VERSION, string(demoUi), mode, reset, mspID, stub.GetTxID(), txTimestamp.Seconds}
+	initRecordAsBytes, err := json.Marshal(initRecord)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	err = stub.PutState(KEY_INIT_RECORD, initRecordAsBytes)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	// start the schema migrations, RunMigration continues them
+	if mode == INIT_MODE_MIGRATE {
+		// the settings written above are not readable before the next transaction
+		batchSize, err := GetConfigInt(stub, CFG_MIGRATION_BATCH_SIZE)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+		_, err = RunPendingMigrations(stub, batchSize)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+	}
+
 	// init modules
 	t.UserMng = new(UserMng)
 
-	LogMessage(" - ready for action") //self-test pass
-	return SuccessPbResponse(nil)
+	LogInfo(stub, "ready for action", LogFields{"mode": mode, "reset": reset}) //self-test pass
+	return SuccessPbResponse(initRecordAsBytes)
+}
+
+// putStateUnlessKept writes a value in mode migrate, in mode keep only if the key is empty
+func putStateUnlessKept(stub shim.ChaincodeStubInterface, key string, value []byte, mode string) error {
+	if mode == INIT_MODE_KEEP {
+		valAsbytes, err := stub.GetState(key)
+		if err != nil {
+			return err
+		} else if valAsbytes != nil {
+			LogInfo(stub, "keep existing key", LogFields{"key": key})
+			return nil
+		}
+	}
+	return stub.PutState(key, value)
 }
 
 // Invoke - Our entry point for Invocations
 // ========================================
 func (t *DomoChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
-	LogMessage("invoke is running " + function)
+	LogDebug(stub, "invoke is running", LogFields{"args": len(args)})
 
+	response, ok := AuthenticateRequest(stub, function, args)
+	if ok {
+		response = t.dispatch(stub, function, args)
+	}
+	LogResponse(stub, response)
+	return response
+}
+
+func (t *DomoChaincode) dispatch(stub shim.ChaincodeStubInterface, function string, args []string) pb.Response {
 	// Handle different functions
-	if function == "Init" { //init the chaincode state, used as reset
-		return t.Init(stub)
+	if function == "Init" { //init the chaincode state, used as reset, admin only
+		return t.Reset(stub, args)
 	} else if function == "Read" { 	//selftest
 		return t.Read(stub, args)
+	} else if function == "RunMigration" { 	//continue the schema migration of a docType, admin only
+		return t.RunMigration(stub, args)
+	} else if function == "GetSchemaState" { 	//read the schema version and migration cursor of a docType
+		return t.GetSchemaState(stub, args)
+	} else if function == "GetConfig" { 	//read the effective settings
+		return t.GetConfig(stub, args)
+	} else if function == "UpdateConfig" { 	//change settings, admin only
+		return t.UpdateConfig(stub, args)
+	} else if function == "GetHistoryForConfig" { 	//read the change history of the settings
+		return t.GetHistoryForConfig(stub, args)
+	} else if function == "RegisterRequestSigner" { 	//register the key of a request signer, admin only
+		return t.RegisterRequestSigner(stub, args)
+	} else if function == "RevokeRequestSigner" { 	//remove a request signer, admin only
+		return t.RevokeRequestSigner(stub, args)
+	} else if function == "GetRequestSigner" { 	//read a request signer
+		return t.GetRequestSigner(stub, args)
+	} else if function == "PruneRequestNonces" { 	//delete expired request nonces, admin only
+		return t.PruneRequestNonces(stub, args)
 	} else if function == "InitUserInfo" { 				//create a new user_info
 		return t.UserMng.InitUserInfo(stub, args)
+	} else if function == "BatchInitUserInfo" { 		//create many user_infos in one transaction
+		return t.UserMng.BatchInitUserInfo(stub, args)
 	} else if function == "ReadUserInfo" { 				//read a user_info
 		return t.UserMng.ReadUserInfo(stub, args)
 	} else if function == "ChangeUserInfo" { 			//changeUserInfo
 		return t.UserMng.ChangeUserInfo(stub, args)
+	} else if function == "RegisterUserPublicKey" { 		//store the signing public key of a user, admin only
+		return t.UserMng.RegisterUserPublicKey(stub, args)
+	} else if function == "BindUserLedgerAccount" { 		//bind a user to its example02 account, admin only
+		return t.UserMng.BindUserLedgerAccount(stub, args)
+	} else if function == "VerifyUserSignature" { 		//check a payload signed by a user
+		return t.UserMng.VerifyUserSignature(stub, args)
 	} else if function == "DeleteUserInfo" { 			//delete user_info
 		return t.UserMng.DeleteUserinfo(stub, args)
 	} else if function == "QueryUserInfoByStatus" { 	//query UserInfo By Status
 		return t.UserMng.QueryUserInfoByStatus(stub, args)
+	} else if function == "CountUserInfoByStatus" { 	//count UserInfo per Status
+		return t.UserMng.CountUserInfoByStatus(stub, args)
+	} else if function == "CountUserInfo" { 			//count UserInfo by selector and groupBy
+		return t.UserMng.CountUserInfo(stub, args)
+	} else if function == "GetUserInfoStatusTotals" { 	//read the maintained UserInfo totals per Status
+		return t.UserMng.GetUserInfoStatusTotals(stub, args)
+	} else if function == "CompactUserInfoStatusTotals" { 	//fold the deltas of the UserInfo status totals
+		return t.UserMng.CompactUserInfoStatusTotals(stub, args)
+	} else if function == "RebuildUserInfoStatusTotals" { 	//recount the UserInfo status totals from the index, admin only
+		return t.UserMng.RebuildUserInfoStatusTotals(stub, args)
 	} else if function == "GetHistoryForUserInfo"{
 		return t.UserMng.GetHistoryForUserInfo(stub, args)
 	}
 
-	LogMessage("invoke did not find func: " + function) //error
+	for _, router := range routers {
+		if response, ok := router.Route(stub, function, args); ok {
+			return response
+		}
+	}
+
+	LogWarning(stub, "invoke did not find func") //error
 	return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Received unknown function invocation")
 }
 
@@ -116,7 +342,7 @@ func (t *DomoChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 func (t *DomoChaincode) Read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var key string
 	var err error
-	LogMessage("starting read")
+	LogDebug(stub, "starting read")
 
 	if len(args) != 1 {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Incorrect number of arguments. Expecting key of the var to query")
@@ -128,6 +354,321 @@ func (t *DomoChaincode) Read(stub shim.ChaincodeStubInterface, args []string) pb
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get state for " + key + ":" + err.Error())
 	}
 
-	LogMessage("- end read")
+	LogDebug(stub, "end read", LogFields{"key": key})
 	return SuccessPbResponse(valAsbytes) //send it onward
 }
+
+// ============================================================================================================================
+// RunMigration - rewrite the next batch of docs of a docType to the code schema version, admin only
+//
+// Inputs - Array of strings
+//  0          1
+//  docType    batch size, optional, defaults to setting migrationBatchSize
+//  "userInfo" "200"
+//
+// Returns the SchemaState, call again until its version equals its target.
+// ============================================================================================================================
+func (t *DomoChaincode) RunMigration(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 && len(args) != 2 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 1 or 2")
+	}
+
+	isAdmin, err := IsAdmin(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if !isAdmin {
+		return ErrorPbResponse(RESP_CODE_PERMISSION_DENIED, "Only admins may run migrations")
+	}
+
+	repo := docRepositories[args[0]]
+	if repo == nil {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "Unknown docType: " + args[0])
+	}
+
+	batchSize, err := GetConfigInt(stub, CFG_MIGRATION_BATCH_SIZE)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	if len(args) == 2 {
+		batchSize, err = strconv.Atoi(args[1])
+		if err != nil || batchSize <= 0 {
+			return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "2nd argument must be a positive integer")
+		}
+	}
+
+	state, err := RunMigrationBatch(stub, repo, batchSize)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	stateAsBytes, err := json.Marshal(state)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(stateAsBytes)
+}
+
+// ============================================================================================================================
+// GetSchemaState - read the ledger schema version and migration cursor of a docType
+//
+// Inputs - Array of strings
+//  0
+//  docType
+//  "userInfo"
+// ============================================================================================================================
+func (t *DomoChaincode) GetSchemaState(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting docType")
+	}
+	if docRepositories[args[0]] == nil {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "Unknown docType: " + args[0])
+	}
+
+	state, err := GetSchemaState(stub, args[0])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	stateAsBytes, err := json.Marshal(state)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(stateAsBytes)
+}
+
+// ============================================================================================================================
+// GetConfig - read every setting, stored value or default
+//
+// Inputs - none
+// ============================================================================================================================
+func (t *DomoChaincode) GetConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 0")
+	}
+
+	config, err := GetConfig(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	configAsBytes, err := json.Marshal(config)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(configAsBytes)
+}
+
+// ============================================================================================================================
+// UpdateConfig - change settings, admin only
+//
+// Inputs - Array of strings
+//  0
+//  settings, JSON object, null resets a setting to its default
+//  "{\"queryBackend\":\"index\",\"maxBatchSize\":null}"
+//
+// Returns the settings after the update, as GetConfig
+// ============================================================================================================================
+func (t *DomoChaincode) UpdateConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting settings")
+	}
+
+	mspID, err := GetCallerMSPID(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get caller MSP ID: " + err.Error())
+	}
+	isAdmin, err := IsAdmin(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if !isAdmin {
+		return ErrorPbResponse(RESP_CODE_PERMISSION_DENIED, "Only admins may update the config, not " + mspID)
+	}
+
+	settings, err := ParseConfigSettings(args[0])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, err.Error())
+	}
+	if adminMSPIDs, ok := settings[CFG_ADMIN_MSP_IDS]; ok && (adminMSPIDs == nil || len(adminMSPIDs.([]string)) == 0) {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Setting " + CFG_ADMIN_MSP_IDS + " can not be emptied")
+	}
+	if adminIdentities, ok := settings[CFG_ADMIN_IDENTITIES]; ok && (adminIdentities == nil || len(adminIdentities.([]string)) == 0) {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Setting " + CFG_ADMIN_IDENTITIES + " can not be emptied")
+	}
+
+	changed, err := PutConfigSettings(stub, settings, true, mspID)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	LogInfo(stub, "config updated", LogFields{"mspId": mspID, "changed": changed})
+
+	// reads in this transaction still see the old state, so merge by hand
+	config, err := GetConfig(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	for name, value := range settings {
+		if value == nil {
+			value = configSettings[name].Default
+		}
+		config[name] = value
+	}
+	configAsBytes, err := json.Marshal(config)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(configAsBytes)
+}
+
+// ============================================================================================================================
+// GetHistoryForConfig - read the stored config docs, latest first, with who changed them
+//
+// Inputs - none
+// ============================================================================================================================
+func (t *DomoChaincode) GetHistoryForConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 0")
+	}
+
+	historyResults, err := GetHistoryForDoc(stub, KEY_CONFIG)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(historyResults)
+}
+
+// ============================================================================================================================
+// RegisterRequestSigner - register or replace the key a signer signs requests with, admin only
+//
+// Inputs - Array of strings
+//  0           1                           2
+//  signerId    algorithm                   key
+//  "app01"     "hmacSha256"                base64 SHA-256 of the secret, the secret itself never goes on the ledger
+//  "app02"     "ecdsaP256"                 PEM public key or certificate
+// ============================================================================================================================
+func (t *DomoChaincode) RegisterRequestSigner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 3")
+	}
+	if len(args[0]) <= 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument must be a non-empty string")
+	}
+
+	mspID, err := GetCallerMSPID(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get caller MSP ID: " + err.Error())
+	}
+	isAdmin, err := IsAdmin(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if !isAdmin {
+		return ErrorPbResponse(RESP_CODE_PERMISSION_DENIED, "Only admins may register request signers, not " + mspID)
+	}
+
+	signer := &RequestSigner{SignerId: args[0], Algorithm: args[1], MspId: mspID}
+	if signer.Algorithm == SIGN_ALG_HMAC_SHA256 {
+		signer.SecretHash = args[2]
+	} else {
+		signer.PublicKey = args[2]
+	}
+	err = PutRequestSigner(stub, signer)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, err.Error())
+	}
+
+	LogInfo(stub, "request signer registered", LogFields{"signerId": signer.SignerId, "algorithm": signer.Algorithm})
+	return SuccessPbResponse(nil)
+}
+
+// ============================================================================================================================
+// RevokeRequestSigner - remove a request signer, its requests are rejected from now on, admin only
+//
+// Inputs - Array of strings
+//  0
+//  signerId
+// ============================================================================================================================
+func (t *DomoChaincode) RevokeRequestSigner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting signerId")
+	}
+
+	isAdmin, err := IsAdmin(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if !isAdmin {
+		return ErrorPbResponse(RESP_CODE_PERMISSION_DENIED, "Only admins may revoke request signers")
+	}
+
+	signer, err := GetRequestSigner(stub, args[0])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if signer == nil {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "Request signer does not exist: " + args[0])
+	}
+	err = stub.DelState(NS_REQUEST_SIGNER + args[0])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	LogInfo(stub, "request signer revoked", LogFields{"signerId": args[0]})
+	return SuccessPbResponse(nil)
+}
+
+// ============================================================================================================================
+// GetRequestSigner - read a request signer
+//
+// Inputs - Array of strings
+//  0
+//  signerId
+// ============================================================================================================================
+func (t *DomoChaincode) GetRequestSigner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting signerId")
+	}
+
+	signer, err := GetRequestSigner(stub, args[0])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if signer == nil {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "Request signer does not exist: " + args[0])
+	}
+	signerAsBytes, err := json.Marshal(signer)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(signerAsBytes)
+}
+
+// ============================================================================================================================
+// PruneRequestNonces - delete request nonces that expired nonceTtl before the transaction time, admin only
+//
+// Inputs - Array of strings
+//  0
+//  max nonces to delete, optional
+//  "1000"
+//
+// Returns the number of deleted nonces, call again while it equals max
+// ============================================================================================================================
+func (t *DomoChaincode) PruneRequestNonces(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	if len(args) > 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 0 or 1")
+	}
+
+	isAdmin, err := IsAdmin(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if !isAdmin {
+		return ErrorPbResponse(RESP_CODE_PERMISSION_DENIED, "Only admins may prune request nonces")
+	}
+
+	max := NONCE_PRUNE_SIZE
+	if len(args) == 1 {
+		max, err = strconv.Atoi(args[0])
+		if err != nil || max <= 0 {
+			return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument must be a positive integer")
+		}
+	}
+
+	pruned, err := PruneRequestNonces(stub, max)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse([]byte(strconv.Itoa(pruned)))
+}
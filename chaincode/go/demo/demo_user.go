@@ -2,6 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
@@ -11,11 +14,23 @@ const (
 	NS_USER_INFO string                 = DT_USER_INFO + "_"
 	PK_FD_USER_INFO string              = "userEmail"
 	IDX_FD_USER_STATUS string           = "userStatus"
+	FD_USER_NICKNAME string             = "userNickname"
+	FD_USER_PWD_HASH string             = "userPwdHash"
 	IDX_UERS_STATUS_2_USER_EMAIL string = IDX_FD_USER_STATUS + "_2_" + PK_FD_USER_INFO
+	CNT_GRP_USER_STATUS string          = NS_USER_INFO + IDX_FD_USER_STATUS // counter group of user totals per status
+)
+
+const (
+	BATCH_MODE_ATOMIC      string = "atomic"      // all or nothing
+	BATCH_MODE_BEST_EFFORT string = "bestEffort"  // write the valid items, skip the others
+	MAX_BATCH_SIZE         int    = 500           // default of setting maxBatchSize, keeps one batch inside a sane read/write set
 )
 
 type UserMng struct {}
 
+// userInfoRepo stores UserInfo under NS_USER_INFO and keeps IDX_uers_status_2_user_email
+var userInfoRepo = NewDocRepository(DT_USER_INFO, PK_FD_USER_INFO, DocIndex{IDX_UERS_STATUS_2_USER_EMAIL, []string{IDX_FD_USER_STATUS}})
+
 type UserInfo struct {
 	//docType is used to distinguish the various types of objects in state database
 	DocType         string `json:"docType"`         //user_info
@@ -23,6 +38,113 @@ type UserInfo struct {
 	UserNickname    string `json:"userNickname"`    //昵称
 	UserPwdHash     string `json:"userPwdHash"`     //密码hash值
 	UserStatus      string `json:"userStatus"`      //当前状态：00-init 99-作废
+	UserPublicKey   string `json:"userPublicKey,omitempty"` //用户签名公钥, PEM, ECDSA P-256
+	UserLedgerAccount string `json:"userLedgerAccount,omitempty"` //账本账户, example02 "<MSP ID>/<enrollment ID>"
+}
+
+// userInfoEncryptableFields may be listed in setting encryptedUserFields, fields
+// used by indexes, queries or the chaincode itself can not
+var userInfoEncryptableFields = []string{FD_USER_NICKNAME, FD_USER_PWD_HASH}
+
+func (u *UserInfo) encryptableFields() map[string]*string {
+	return map[string]*string{FD_USER_NICKNAME: &u.UserNickname, FD_USER_PWD_HASH: &u.UserPwdHash}
+}
+
+// userInfoEncryption returns the fields to encrypt and the transient key,
+// ErrEncryptionKeyRequired if fields are configured but no key was passed
+func userInfoEncryption(stub shim.ChaincodeStubInterface) ([]string, []byte, error) {
+	fields, err := GetConfigStrings(stub, CFG_ENCRYPTED_USER_FIELDS)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := GetTransientEncryptionKey(stub)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(fields) > 0 && key == nil {
+		return nil, nil, ErrEncryptionKeyRequired
+	}
+	return fields, key, nil
+}
+
+// transientUserFields reads TRANSIENT_USER_FIELDS, empty if it was not passed
+func transientUserFields(stub shim.ChaincodeStubInterface) (map[string]map[string]string, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	fieldsAsBytes, ok := transient[TRANSIENT_USER_FIELDS]
+	if !ok {
+		return map[string]map[string]string{}, nil
+	}
+	userFields := make(map[string]map[string]string)
+	err = json.Unmarshal(fieldsAsBytes, &userFields)
+	if err != nil {
+		return nil, errors.New("Malformed " + TRANSIENT_USER_FIELDS + ": " + err.Error())
+	}
+	return userFields, nil
+}
+
+// setTransientUserFields takes the plaintext of the fields to encrypt from
+// TRANSIENT_USER_FIELDS, their args must be empty so it stays out of the block
+func setTransientUserFields(userInfo *UserInfo, fields []string, userFields map[string]map[string]string) error {
+	encryptable := userInfo.encryptableFields()
+	for _, field := range fields {
+		if *encryptable[field] != "" {
+			return errors.New(field + " is stored encrypted, leave its argument empty and pass it in transient field " + TRANSIENT_USER_FIELDS)
+		}
+		*encryptable[field] = userFields[userInfo.UserEmail][field]
+	}
+	return nil
+}
+
+// encryptUserInfo encrypts the plaintext fields of a UserInfo
+func encryptUserInfo(stub shim.ChaincodeStubInterface, userInfo *UserInfo, fields []string, key []byte) error {
+	docKey, err := userInfoRepo.Key(userInfo.UserEmail)
+	if err != nil {
+		return err
+	}
+	encryptable := userInfo.encryptableFields()
+	for _, field := range fields {
+		*encryptable[field], err = EncryptFieldValue(stub, key, docKey, field, *encryptable[field])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptUserInfo decrypts the encrypted fields of a UserInfo, key may be nil if none is
+func decryptUserInfo(userInfo *UserInfo, key []byte) error {
+	docKey, err := userInfoRepo.Key(userInfo.UserEmail)
+	if err != nil {
+		return err
+	}
+	for field, value := range userInfo.encryptableFields() {
+		if !IsEncryptedFieldValue(*value) {
+			continue
+		}
+		if key == nil {
+			return ErrEncryptionKeyRequired
+		}
+		*value, err = DecryptFieldValue(key, docKey, field, *value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptUserInfoResponse decrypts the UserInfos in a response when a key was passed.
+// The chaincode can not tell a query from an invoke, and the response of an invoke is
+// endorsed into the block: clients must pass the key only when they evaluate the
+// function as a query, never when they submit it.
+func decryptUserInfoResponse(stub shim.ChaincodeStubInterface, responseJSON []byte) ([]byte, error) {
+	key, err := GetTransientEncryptionKey(stub)
+	if err != nil || key == nil {
+		return responseJSON, err
+	}
+	return DecryptDocsJSON(key, userInfoRepo, responseJSON)
 }
 
 
@@ -38,73 +160,256 @@ func (t *UserMng) InitUserInfo(stub shim.ChaincodeStubInterface, args []string)
 	}
 
 	// ==== Input sanitation ====
-	LogMessage("- start init user")
+	LogDebug(stub, "start InitUserInfo")
 	if len(args[0]) <= 0 {
 		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR,"1st argument must be a non-empty string")
 	}
-	if len(args[1]) <= 0 {
-		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR,"2nd argument must be a non-empty string")
-	}
-	if len(args[2]) <= 0 {
-		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR,"3rd argument must be a non-empty string")
-	}
 
 	email 		:= args[0]
 	nickname 	:= args[1]
 	pwdHash 	:= args[2]
 
-	// ==== Check if user_info already exists ====
-	userInfoAsBytes, err := GetDocWithNamespace(stub, NS_USER_INFO, email)
+	// ==== Create user_info object, encrypted fields come from the transient map ====
+	userInfo := UserInfo{DT_USER_INFO, email, nickname, pwdHash, ST_COMM_INIT, "", ""}
+	encryptedFields, key, err := userInfoEncryption(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, err.Error())
+	}
+	userFields, err := transientUserFields(stub)
+	if err == nil {
+		err = setTransientUserFields(&userInfo, encryptedFields, userFields)
+	}
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, err.Error())
+	}
+	if len(userInfo.UserNickname) <= 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR,"2nd argument must be a non-empty string")
+	}
+	if len(userInfo.UserPwdHash) <= 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR,"3rd argument must be a non-empty string")
+	}
+
+	// ==== save and index it if it does not exist yet ====
+	err = encryptUserInfo(stub, &userInfo, encryptedFields, key)
 	if err != nil {
-		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get UserInfo: " + err.Error())
-	} else if userInfoAsBytes != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	statusTotals := NewCounterDeltas(CNT_GRP_USER_STATUS)
+	err = t.putNewUserInfo(stub, &userInfo, statusTotals)
+	if err == ErrDocAlreadyExists {
 		return ErrorPbResponse(RESP_CODE_DATA_ALREADY_EXIST, "This UserInfo already exists: " + email)
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	err = statusTotals.Flush(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	// ==== user_info saved and indexed. Return success ====
+	LogInfo(stub, "end InitUserInfo", LogFields{"userInfo": userInfo})
+	return SuccessPbResponse(nil)
+}
+
+// ============================================================
+// putNewUserInfo - store and index a new userInfo and count it in statusTotals
+// ============================================================
+func (t *UserMng) putNewUserInfo(stub shim.ChaincodeStubInterface, userInfo *UserInfo, statusTotals *CounterDeltas) error {
+	err := userInfoRepo.Insert(stub, userInfo)
+	if err != nil {
+		return err
+	}
+
+	statusTotals.Add(userInfo.UserStatus, 1)
+	return nil
+}
+
+// ============================================================
+// BatchInitUserInfo - create many userInfos in one transaction
+//
+// Inputs - Array of strings
+//  0                1
+//  mode             users
+//  "atomic"         "[{\"userEmail\":\"a@b.com\",\"userNickname\":\"a\",\"userPwdHash\":\"...\"}]"
+//
+// mode "atomic" writes nothing unless every user is valid, mode "bestEffort"
+// writes the valid users and skips the others. Each user gets an item result.
+// Fields listed in encryptedUserFields are left out and passed in transient
+// field TRANSIENT_USER_FIELDS.
+// ============================================================
+func (t *UserMng) BatchInitUserInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+
+	if len(args) != 2 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 2")
+	}
+
+	mode := args[0]
+	if mode != BATCH_MODE_ATOMIC && mode != BATCH_MODE_BEST_EFFORT {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument must be " + BATCH_MODE_ATOMIC + " or " + BATCH_MODE_BEST_EFFORT)
 	}
 
-	// ==== Create user_info object and marshal to JSON ====
-	userInfo := UserInfo{DT_USER_INFO, email, nickname, pwdHash, ST_COMM_INIT}
-	userInfoJSONasBytes, err := json.Marshal(userInfo)
+	var userInfos []UserInfo
+	err = json.Unmarshal([]byte(args[1]), &userInfos)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "2nd argument must be a JSON array of UserInfo: " + err.Error())
+	}
+	if len(userInfos) == 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "2nd argument must contain at least one UserInfo")
+	}
+	maxBatchSize, err := GetConfigInt(stub, CFG_MAX_BATCH_SIZE)
 	if err != nil {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
 	}
+	if len(userInfos) > maxBatchSize {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Too many UserInfos in one batch. Expecting at most " + strconv.Itoa(maxBatchSize))
+	}
+	encryptedFields, key, err := userInfoEncryption(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, err.Error())
+	}
+	userFields, err := transientUserFields(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, err.Error())
+	}
+
+	LogDebug(stub, "start BatchInitUserInfo", LogFields{"mode": mode, "size": len(userInfos)})
+
+	// ==== Validate every user before writing anything ====
+	// GetState does not see writes of the same transaction, so duplicates
+	// inside the batch have to be tracked here.
+	result := BatchResult{Mode: mode, Total: len(userInfos)}
+	seen := make(map[string]bool)
+	for i := range userInfos {
+		userInfo := &userInfos[i]
+		item := BatchItemResult{Index: i, Key: userInfo.UserEmail, Code: RESP_CODE_SUCESS}
+
+		err = setTransientUserFields(userInfo, encryptedFields, userFields)
+		if err != nil {
+			item.Code = RESP_CODE_ARGUMENTS_ERROR
+			item.Error = err.Error()
+		} else if len(userInfo.UserEmail) <= 0 || len(userInfo.UserNickname) <= 0 || len(userInfo.UserPwdHash) <= 0 {
+			item.Code = RESP_CODE_ARGUMENTS_ERROR
+			item.Error = "userEmail, userNickname and userPwdHash must be non-empty strings"
+		} else if seen[userInfo.UserEmail] {
+			item.Code = RESP_CODE_DATA_ALREADY_EXIST
+			item.Error = "This UserInfo is duplicated in the batch: " + userInfo.UserEmail
+		} else {
+			exists, err := userInfoRepo.Exists(stub, userInfo.UserEmail)
+			if err != nil {
+				item.Code = RESP_CODE_SYSTEM_ERROR
+				item.Error = "Failed to get UserInfo: " + err.Error()
+			} else if exists {
+				item.Code = RESP_CODE_DATA_ALREADY_EXIST
+				item.Error = "This UserInfo already exists: " + userInfo.UserEmail
+			}
+		}
+
+		if item.Code == RESP_CODE_SUCESS {
+			seen[userInfo.UserEmail] = true
+		} else {
+			result.Failed++
+		}
+		result.Items = append(result.Items, item)
+	}
 
-	// === Save user_info to state ===
-	err = PutDocWithNamespace(stub, NS_USER_INFO, email, userInfoJSONasBytes)
+	if mode == BATCH_MODE_ATOMIC && result.Failed > 0 {
+		resultAsBytes, err := json.Marshal(result)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+		return ErrorPbResponseWithData(RESP_CODE_ARGUMENTS_ERROR, strconv.Itoa(result.Failed) + " of " + strconv.Itoa(result.Total) + " UserInfos are invalid, nothing was written", resultAsBytes)
+	}
+
+	// ==== Save and index the valid users ====
+	statusTotals := NewCounterDeltas(CNT_GRP_USER_STATUS)
+	for i := range userInfos {
+		if result.Items[i].Code != RESP_CODE_SUCESS {
+			continue
+		}
+		userInfo := UserInfo{DT_USER_INFO, userInfos[i].UserEmail, userInfos[i].UserNickname, userInfos[i].UserPwdHash, ST_COMM_INIT, "", ""}
+		err = encryptUserInfo(stub, &userInfo, encryptedFields, key)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+		err = t.putNewUserInfo(stub, &userInfo, statusTotals)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+		result.Succeeded++
+	}
+	err = statusTotals.Flush(stub)
 	if err != nil {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
 	}
 
-	//create IDX_uers_status_2_user_email
-	err = CreateCKeyWithNamespace(stub, NS_USER_INFO, IDX_UERS_STATUS_2_USER_EMAIL, []string{userInfo.UserStatus,userInfo.UserEmail})
+	resultAsBytes, err := json.Marshal(result)
 	if err != nil {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
 	}
-	
-	// ==== user_info saved and indexed. Return success ====
-	LogMessage("- end init user_info")
-	return SuccessPbResponse(nil)
+
+	LogInfo(stub, "end BatchInitUserInfo", LogFields{"succeeded": result.Succeeded, "failed": result.Failed})
+	return SuccessPbResponse(resultAsBytes)
 }
 
 // ===============================================
 // readUserInfo - read a user_info from chaincode state
+//
+// Inputs - Array of strings
+//  0                   1
+//  UserEmail           "withBalance", optional, adds the ledger balance, see ledger_client.go
+//  "a@test.com"        "withBalance"
 // ===============================================
 func (t *UserMng) ReadUserInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var email string
 	var err error
 
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
 		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR,"Incorrect number of arguments. Expecting UserEmail")
 	}
+	if len(args) == 2 && args[1] != READ_WITH_BALANCE {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "2nd argument must be " + READ_WITH_BALANCE)
+	}
 
 	email = args[0]
-	valAsbytes, err := GetDocWithNamespace(stub, NS_USER_INFO, email) //get the user_info from chaincode state
+	valAsbytes, err := userInfoRepo.GetBytes(stub, email) //get the user_info from chaincode state
 	if err != nil {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
 	} else if valAsbytes == nil {
 		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "UserInfo does not exist: " + email )
 	}
+	valAsbytes, err = decryptUserInfoResponse(stub, valAsbytes)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, err.Error())
+	}
+
+	if len(args) == 2 {
+		// ==== the balance is null while the ledger has no entity for the user ====
+		userInfoWithBalance := make(map[string]json.RawMessage)
+		err = json.Unmarshal(valAsbytes, &userInfoWithBalance)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+		userInfo := UserInfo{}
+		err = json.Unmarshal(valAsbytes, &userInfo)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+		balance, err := GetUserLedgerBalance(stub, &userInfo)
+		if err != nil {
+			return LedgerErrorPbResponse(err)
+		}
+		userInfoWithBalance[FD_LEDGER_BALANCE], err = json.Marshal(balance)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+		valAsbytes, err = json.Marshal(userInfoWithBalance)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+	}
 
-	LogMessage("- end read UserInfo")
+	LogDebug(stub, "end ReadUserInfo")
 	return SuccessPbResponse(valAsbytes)
 }
 
@@ -127,40 +432,65 @@ func (t *UserMng) DeleteUserinfo(stub shim.ChaincodeStubInterface, args []string
 
 	email := args[0]
 
-	LogMessage("- start DeleteUserinfo: UserEmail " + email )
+	LogDebug(stub, "start DeleteUserinfo", LogFields{"userEmail": email})
 
-	ValAsbytes, err := GetDocWithNamespace(stub, NS_USER_INFO, email) //get the UserInfo from chaincode state
-	if err != nil {
+	userInfoToUpdate := UserInfo{}
+	err = userInfoRepo.Get(stub, email, &userInfoToUpdate) //get the UserInfo from chaincode state
+	if err == ErrDocNotExisted {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "user_info does not exist: " + email)
+	} else if err != nil {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get doc for " + NS_USER_INFO + email + ":" + err.Error())
-	} else if ValAsbytes == nil {
-		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "user_info does not exist: " + email + ":" + err.Error())
 	}
 
-	userInfoToUpdate := UserInfo{}
-	err = json.Unmarshal(ValAsbytes, &userInfoToUpdate)
+	// ==== a user can not be deleted while the ledger holds a balance for it ====
+	ledgerConfigured, err := LedgerConfigured(stub)
 	if err != nil {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
 	}
+	if ledgerConfigured && userInfoToUpdate.UserStatus != ST_COMM_NILED {
+		balance, err := GetUserLedgerBalance(stub, &userInfoToUpdate)
+		if err != nil {
+			return LedgerErrorPbResponse(err)
+		}
+		if balance != nil && balance.Foreign {
+			// ==== an entity the user does not own can not keep it from being deleted ====
+			LogWarning(stub, "ledger entity of UserInfo is owned by another account, not checked", LogFields{"userEmail": email, "owner": balance.Owner, "amount": balance.Amount})
+		} else if balance != nil && !balance.IsZero() {
+			return ErrorPbResponse(RESP_CODE_BALANCE_NOT_ZERO, "UserInfo " + email + " still holds " + balance.Amount + " on the ledger")
+		}
+	}
 
 	if userInfoToUpdate.UserStatus == ST_COMM_NILED {
-		LogMessage("- end delete user_info (success) " +  email + "s UserInfo was already deleted!")
+		LogInfo(stub, "end DeleteUserinfo (success), UserInfo was already deleted", LogFields{"userEmail": email})
 	}else {
+		oldStatus := userInfoToUpdate.UserStatus
 		userInfoToUpdate.UserStatus = ST_COMM_NILED
 
-		userInfoJSONasBytes, err := json.Marshal(userInfoToUpdate)
+		// save and move IDX_uers_status_2_user_email to the new status
+		err = userInfoRepo.Update(stub, &userInfoToUpdate)
 		if err != nil {
 			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
 		}
 
-		err = PutDocWithNamespace(stub, NS_USER_INFO, email, userInfoJSONasBytes)
+		err = t.countUserStatusChange(stub, oldStatus, userInfoToUpdate.UserStatus)
 		if err != nil {
 			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
 		}
 	}
-	LogMessage("- end DeleteUserinfo (success)")
+	LogInfo(stub, "end DeleteUserinfo (success)", LogFields{"userEmail": email})
 	return SuccessPbResponse(nil)
 }
 
+// ==================================================
+// countUserStatusChange - keep the status totals in step with a status change
+// ==================================================
+func (t *UserMng) countUserStatusChange(stub shim.ChaincodeStubInterface, oldStatus string, newStatus string) error {
+	statusTotals := NewCounterDeltas(CNT_GRP_USER_STATUS)
+	statusTotals.Add(oldStatus, -1)
+	statusTotals.Add(newStatus, 1)
+	return statusTotals.Flush(stub)
+}
+
 // ==================================================
 // Change UserInfo key/value pair from state
 // ==================================================
@@ -176,30 +506,45 @@ func (t *UserMng) ChangeUserInfo(stub shim.ChaincodeStubInterface, args []string
 	if len(args[0]) <= 0 {
 		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument must be a non-empty string")
 	}
-	if len(args[1]) <= 0 {
+
+	email := args[0]
+
+	// ==== encrypted fields come from the transient map ====
+	newUserInfo := UserInfo{UserEmail: email, UserNickname: args[1], UserPwdHash: args[2]}
+	encryptedFields, key, err := userInfoEncryption(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, err.Error())
+	}
+	userFields, err := transientUserFields(stub)
+	if err == nil {
+		err = setTransientUserFields(&newUserInfo, encryptedFields, userFields)
+	}
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, err.Error())
+	}
+	if len(newUserInfo.UserNickname) <= 0 {
 		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "2nd argument must be a non-empty string")
 	}
-	if len(args[2]) <= 0 {
+	if len(newUserInfo.UserPwdHash) <= 0 {
 		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "3rd argument must be a non-empty string")
 	}
+	nickname := newUserInfo.UserNickname
+	pwdHash := newUserInfo.UserPwdHash
 
-	email := args[0]
-	nickname := args[1]
-	pwdHash := args[2]
-
-	LogMessage("- start ChangeUserInfo: UserEmail " + email + " , UserNickname " + nickname + " , UserPwdHash " + pwdHash)
+	LogDebug(stub, "start ChangeUserInfo", LogFields{"userEmail": email, "userNickname": args[1], "userPwdHash": pwdHash})
 		
-	ValAsbytes, err := GetDocWithNamespace(stub, NS_USER_INFO, email) //get the UserInfo from chaincode state
-	if err != nil {
-		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get doc for " + NS_USER_INFO + email + ":" + err.Error())
-	} else if ValAsbytes == nil {
+	userInfoToUpdate := UserInfo{}
+	err = userInfoRepo.Get(stub, email, &userInfoToUpdate) //get the UserInfo from chaincode state
+	if err == ErrDocNotExisted {
 		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "user_info does not exist: " + email)
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get doc for " + NS_USER_INFO + email + ":" + err.Error())
 	}
-	
-	userInfoToUpdate := UserInfo{}
-	err = json.Unmarshal(ValAsbytes, &userInfoToUpdate)
+
+	// compare and store the plaintext, encrypted fields are encrypted again below
+	err = decryptUserInfo(&userInfoToUpdate, key)
 	if err != nil {
-		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, err.Error())
 	}
 
 	var isChanged bool
@@ -215,26 +560,156 @@ func (t *UserMng) ChangeUserInfo(stub shim.ChaincodeStubInterface, args []string
 	}
 	
 	if !isChanged {
-		LogMessage("- end changeUserInfo (no change no commit)")
+		LogInfo(stub, "end ChangeUserInfo (no change no commit)", LogFields{"userEmail": email})
 		return SuccessPbResponse(nil)
 	}
 	
-	userInfoJSONasBytes, err := json.Marshal(userInfoToUpdate)
+	err = encryptUserInfo(stub, &userInfoToUpdate, encryptedFields, key)
 	if err != nil {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
 	}
-		
-	err = PutDocWithNamespace(stub, NS_USER_INFO, email, userInfoJSONasBytes)
+	err = userInfoRepo.Update(stub, &userInfoToUpdate)
 	if err != nil {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
 	}
 
-	LogMessage("- end ChangeUserInfo (success)")
+	LogInfo(stub, "end ChangeUserInfo (success)", LogFields{"userEmail": email})
 	return SuccessPbResponse(nil)
 }
 
+// ============================================================
+// RegisterUserPublicKey - store the public key a user signs with, admin only
+//
+// The user can then sign requests as signer "user:" + userEmail and
+// business payloads checked by VerifyUserSignature.
+// ============================================================
+func (t *UserMng) RegisterUserPublicKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+
+	// "UserEmail",   "-----BEGIN PUBLIC KEY-----..." or "-----BEGIN CERTIFICATE-----..."
+	if len(args) != 2 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 2")
+	}
+
+	isAdmin, err := IsAdmin(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if !isAdmin {
+		return ErrorPbResponse(RESP_CODE_PERMISSION_DENIED, "Only admins may register user public keys")
+	}
+
+	email := args[0]
+	publicKey := args[1]
+	algorithm, err := PublicKeyAlgorithm(publicKey)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "2nd argument: " + err.Error())
+	}
+
+	userInfoToUpdate := UserInfo{}
+	err = userInfoRepo.Get(stub, email, &userInfoToUpdate)
+	if err == ErrDocNotExisted {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "user_info does not exist: " + email)
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get doc for " + NS_USER_INFO + email + ":" + err.Error())
+	}
+	if userInfoToUpdate.UserStatus == ST_COMM_NILED {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "user_info was deleted: " + email)
+	}
+
+	userInfoToUpdate.UserPublicKey = publicKey
+	err = userInfoRepo.Update(stub, &userInfoToUpdate)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	LogInfo(stub, "end RegisterUserPublicKey (success)", LogFields{"userEmail": email, "algorithm": algorithm})
+	return SuccessPbResponse(nil)
+}
+
+// ============================================================
+// BindUserLedgerAccount - bind a user to the example02 account that owns its balance, admin only
+//
+// Inputs - Array of strings
+//  0                   1
+//  UserEmail           example02 account "<MSP ID>/<enrollment ID>", see ledger_client.go
+//  "a@test.com"        "Org1MSP/user1"
+// ============================================================
+func (t *UserMng) BindUserLedgerAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+
+	if len(args) != 2 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 2")
+	}
+
+	isAdmin, err := IsAdmin(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if !isAdmin {
+		return ErrorPbResponse(RESP_CODE_PERMISSION_DENIED, "Only admins may bind user ledger accounts")
+	}
+
+	email := args[0]
+	account := args[1]
+	if !IsLedgerAccount(account) {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "2nd argument must be an account \"<MSP ID>/<enrollment ID>\"")
+	}
+
+	userInfoToUpdate := UserInfo{}
+	err = userInfoRepo.Get(stub, email, &userInfoToUpdate)
+	if err == ErrDocNotExisted {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "user_info does not exist: " + email)
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get doc for " + NS_USER_INFO + email + ":" + err.Error())
+	}
+	if userInfoToUpdate.UserStatus == ST_COMM_NILED {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "user_info was deleted: " + email)
+	}
+
+	userInfoToUpdate.UserLedgerAccount = account
+	err = userInfoRepo.Update(stub, &userInfoToUpdate)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	LogInfo(stub, "end BindUserLedgerAccount (success)", LogFields{"userEmail": email, "account": account})
+	return SuccessPbResponse(nil)
+}
+
+// ============================================================
+// VerifyUserSignature - check a payload signed with the registered key of a user
+//
+// ECDSA signatures are base64 DER over the SHA-256 of the payload.
+// Returns {"valid":true|false}.
+// ============================================================
+func (t *UserMng) VerifyUserSignature(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	// "UserEmail",   "payload", "signature"
+	if len(args) != 3 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 3")
+	}
+
+	email := args[0]
+	userInfo := UserInfo{}
+	err := userInfoRepo.Get(stub, email, &userInfo)
+	if err == ErrDocNotExisted {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "user_info does not exist: " + email)
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	if userInfo.UserPublicKey == "" {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "user_info has no public key: " + email)
+	}
+
+	valid, err := VerifySignature(userInfo.UserPublicKey, args[1], args[2])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse([]byte(`{"valid":` + strconv.FormatBool(valid) + `}`))
+}
+
 // ===============================================
 // queryUserInfoByStatus - read a user_info from chaincode state
+//
+// Setting queryBackend picks a CouchDB rich query or the status index
 // ===============================================
 func (t *UserMng) QueryUserInfoByStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	// 0
@@ -245,10 +720,24 @@ func (t *UserMng) QueryUserInfoByStatus(stub shim.ChaincodeStubInterface, args [
 
 	userStatus := args[0]
 
-	queryResults, err := QueryDocsByIdxkey(stub, DT_USER_INFO, IDX_FD_USER_STATUS, userStatus)
+	queryBackend, err := GetConfigString(stub, CFG_QUERY_BACKEND)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	var queryResults []byte
+	if queryBackend == QUERY_BACKEND_INDEX {
+		queryResults, err = userInfoRepo.QueryByIndex(stub, IDX_UERS_STATUS_2_USER_EMAIL, []string{userStatus})
+	} else {
+		queryResults, err = QueryDocsByIdxkey(stub, DT_USER_INFO, IDX_FD_USER_STATUS, userStatus)
+	}
 	if err != nil {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
 	}
+	queryResults, err = decryptUserInfoResponse(stub, queryResults)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, err.Error())
+	}
 	return SuccessPbResponse(queryResults)
 }
 
@@ -258,13 +747,243 @@ func (t *UserMng) GetHistoryForUserInfo(stub shim.ChaincodeStubInterface, args [
 	}
 
 	email := args[0]
-	LogMessage("- start getHistoryForAssetOwner: " + email)
+	LogDebug(stub, "start GetHistoryForUserInfo", LogFields{"userEmail": email})
 
-	historyUserInfoBytes, err :=  GetHistoryForDocWithNamespace(stub, NS_USER_INFO, email)
+	historyUserInfoBytes, err :=  userInfoRepo.History(stub, email)
 	if err != nil {
 		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR,err.Error())
 	}
+	historyUserInfoBytes, err = decryptUserInfoResponse(stub, historyUserInfoBytes)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, err.Error())
+	}
 
 	return SuccessPbResponse(historyUserInfoBytes)
 }
 
+
+// ===============================================
+// CountUserInfoByStatus - count user_infos per status from IDX_uers_status_2_user_email
+//
+// Inputs - Array of strings, optional
+//  0       1
+//  status  status ...
+//  "00"    "99"
+//
+// Without arguments every status is counted.
+// ===============================================
+func (t *UserMng) CountUserInfoByStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	result := &AggregateResult{Groups: []AggregateGroup{}}
+	if len(args) == 0 {
+		var err error
+		result, err = userInfoRepo.CountByIndex(stub, IDX_UERS_STATUS_2_USER_EMAIL, []string{}, []string{IDX_FD_USER_STATUS})
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+	}
+
+	for _, userStatus := range args {
+		if len(userStatus) <= 0 {
+			return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "status arguments must be non-empty strings")
+		}
+		statusResult, err := userInfoRepo.CountByIndex(stub, IDX_UERS_STATUS_2_USER_EMAIL, []string{userStatus}, []string{})
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+		result.Total += statusResult.Total
+		result.Groups = append(result.Groups, AggregateGroup{map[string]string{IDX_FD_USER_STATUS: userStatus}, statusResult.Total})
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(resultAsBytes)
+}
+
+// ===============================================
+// CountUserInfo - count user_infos matching a selector, grouped by fields
+//
+// Inputs - Array of strings
+//  0
+//  query
+//  "{\"selector\":{\"userStatus\":\"00\"},\"groupBy\":[\"userNickname\"]}"
+//
+// The selector only supports equality on fields, encrypted fields can not be used.
+// When the selector and groupBy only use userStatus the status index is scanned,
+// otherwise the user_info docs are.
+// ===============================================
+func (t *UserMng) CountUserInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting count query")
+	}
+
+	var query struct {
+		Selector map[string]string `json:"selector"`
+		GroupBy  []string          `json:"groupBy"`
+	}
+	err := json.Unmarshal([]byte(args[0]), &query)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument must be a count query {\"selector\":{},\"groupBy\":[]}: " + err.Error())
+	}
+	if query.GroupBy == nil {
+		query.GroupBy = []string{}
+	}
+
+	// encrypted values differ per write, counting them is meaningless
+	encryptedFields, err := GetConfigStrings(stub, CFG_ENCRYPTED_USER_FIELDS)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	for _, field := range encryptedFields {
+		_, inSelector := query.Selector[field]
+		inGroupBy := false
+		for _, groupBy := range query.GroupBy {
+			inGroupBy = inGroupBy || groupBy == field
+		}
+		if inSelector || inGroupBy {
+			return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, field + " is encrypted and can not be queried")
+		}
+	}
+
+	onIndex := true
+	for field := range query.Selector {
+		if field != IDX_FD_USER_STATUS && field != "docType" {
+			onIndex = false
+		}
+	}
+	for _, field := range query.GroupBy {
+		if field != IDX_FD_USER_STATUS {
+			onIndex = false
+		}
+	}
+	if docType, ok := query.Selector["docType"]; ok && docType != DT_USER_INFO {
+		onIndex = false
+	}
+
+	var result *AggregateResult
+	if onIndex {
+		partialKey := []string{}
+		if userStatus, ok := query.Selector[IDX_FD_USER_STATUS]; ok {
+			partialKey = append(partialKey, userStatus)
+		}
+		result, err = userInfoRepo.CountByIndex(stub, IDX_UERS_STATUS_2_USER_EMAIL, partialKey, query.GroupBy)
+	} else {
+		result, err = userInfoRepo.CountBySelector(stub, query.Selector, query.GroupBy)
+	}
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(resultAsBytes)
+}
+
+// ===============================================
+// GetUserInfoStatusTotals - read the maintained user totals per status
+//
+// Unlike CountUserInfoByStatus no index is scanned, only the counter keys.
+// Inputs - Array of strings, optional
+//  0       1
+//  status  status ...
+//  "00"    "99"
+// ===============================================
+func (t *UserMng) GetUserInfoStatusTotals(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	counters, err := GetCounters(stub, CNT_GRP_USER_STATUS)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	statuses := args
+	if len(statuses) == 0 {
+		for userStatus := range counters {
+			statuses = append(statuses, userStatus)
+		}
+		sort.Strings(statuses)
+	}
+
+	result := AggregateResult{Groups: []AggregateGroup{}}
+	for _, userStatus := range statuses {
+		count := int(counters[userStatus])
+		result.Total += count
+		result.Groups = append(result.Groups, AggregateGroup{map[string]string{IDX_FD_USER_STATUS: userStatus}, count})
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(resultAsBytes)
+}
+
+// ===============================================
+// CompactUserInfoStatusTotals - fold the per-transaction deltas of the status totals
+//
+// Inputs - Array of strings, optional
+//  0
+//  max deltas to fold, default all
+//  "1000"
+// ===============================================
+func (t *UserMng) CompactUserInfoStatusTotals(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 0 or 1")
+	}
+
+	maxDeltas := 0
+	if len(args) == 1 {
+		var err error
+		maxDeltas, err = strconv.Atoi(args[0])
+		if err != nil || maxDeltas <= 0 {
+			return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument must be a positive integer")
+		}
+	}
+
+	compacted, err := CompactCounters(stub, CNT_GRP_USER_STATUS, maxDeltas)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	LogInfo(stub, "end CompactUserInfoStatusTotals", LogFields{"compacted": compacted})
+	return SuccessPbResponse([]byte("{\"compacted\":" + strconv.Itoa(compacted) + "}"))
+}
+
+// ===============================================
+// RebuildUserInfoStatusTotals - recount the status totals from IDX_uers_status_2_user_email
+//
+// Seeds the totals of users created before the counters existed, admin only.
+// ===============================================
+func (t *UserMng) RebuildUserInfoStatusTotals(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 0")
+	}
+
+	isAdmin, err := IsAdmin(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if !isAdmin {
+		return ErrorPbResponse(RESP_CODE_PERMISSION_DENIED, "Only admins may rebuild the UserInfo status totals")
+	}
+
+	result, err := userInfoRepo.CountByIndex(stub, IDX_UERS_STATUS_2_USER_EMAIL, []string{}, []string{IDX_FD_USER_STATUS})
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	values := make(map[string]int64)
+	for _, group := range result.Groups {
+		values[group.Key[IDX_FD_USER_STATUS]] = int64(group.Count)
+	}
+	err = ResetCounters(stub, CNT_GRP_USER_STATUS, values)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(resultAsBytes)
+}
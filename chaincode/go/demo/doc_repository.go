@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"regexp"
+	"unicode/utf8"
+)
+
+// DocRepository stores one docType as JSON docs and maintains its secondary indexes.
+//
+//  doc   key: {docType}_{id}
+//  index key: composite key {docType}_{indexName} {field values...} {id}
+//
+// docType may only hold letters and digits, so the "{docType}_" prefix can never be
+// the prefix of another docType and the id after it needs no escaping. Index names
+// are unique per docType and end at the 0x00 separator of the composite key, index
+// values go through CreateCompositeKey, which rejects that separator.
+//
+// Docs are stamped with the schema version of their docType and upcast when they are
+// read, see schema_migration.go.
+type DocRepository struct {
+	DocType string
+	IdField string
+	Indexes []DocIndex
+}
+
+// DocIndex is a secondary index on the JSON fields of a doc, the id is always appended
+type DocIndex struct {
+	Name   string
+	Fields []string
+}
+
+var (
+	ErrDocAlreadyExists = errors.New("doc already exists")
+	ErrDocNotExisted    = errors.New("doc does not exist")
+
+	docTypePattern   = regexp.MustCompile("^[A-Za-z0-9]+$")
+	indexNamePattern = regexp.MustCompile("^[A-Za-z0-9_]+$")
+
+	// every repository by docType, used to run their migrations
+	docRepositories = make(map[string]*DocRepository)
+)
+
+// NewDocRepository panics on an invalid docType or index, like regexp.MustCompile:
+// repositories are package variables and a bad name is a programming error.
+func NewDocRepository(docType string, idField string, indexes ...DocIndex) *DocRepository {
+	if !docTypePattern.MatchString(docType) {
+		panic("invalid docType " + docType + ", expecting letters and digits only")
+	}
+	if docType+"_" == NS_RESERVED {
+		panic("docType " + docType + " is reserved for the chaincode keys")
+	}
+	if docRepositories[docType] != nil {
+		panic("duplicated repository for docType " + docType)
+	}
+	names := make(map[string]bool)
+	for _, index := range indexes {
+		if !indexNamePattern.MatchString(index.Name) || names[index.Name] {
+			panic("invalid or duplicated index " + index.Name + " for docType " + docType)
+		}
+		names[index.Name] = true
+	}
+	repo := &DocRepository{docType, idField, indexes}
+	docRepositories[docType] = repo
+	return repo
+}
+
+// Namespace is the prefix of every doc key of the repository
+func (r *DocRepository) Namespace() string {
+	return r.DocType + "_"
+}
+
+func (r *DocRepository) Key(id string) (string, error) {
+	if len(id) == 0 {
+		return "", errors.New(r.DocType + " id should not be empty")
+	}
+	if !utf8.ValidString(id) {
+		return "", errors.New(r.DocType + " id is not a valid utf8 string: " + id)
+	}
+	return r.Namespace() + id, nil
+}
+
+func (r *DocRepository) Exists(stub shim.ChaincodeStubInterface, id string) (bool, error) {
+	valAsbytes, err := r.GetBytes(stub, id)
+	return valAsbytes != nil, err
+}
+
+// GetBytes returns the JSON of a doc upcast to the code schema version, nil if it does not exist
+func (r *DocRepository) GetBytes(stub shim.ChaincodeStubInterface, id string) ([]byte, error) {
+	valAsbytes, err := r.getRawBytes(stub, id)
+	if err != nil || valAsbytes == nil {
+		return valAsbytes, err
+	}
+	return r.upcastBytes(valAsbytes)
+}
+
+// getRawBytes returns the JSON of a doc as stored on the ledger
+func (r *DocRepository) getRawBytes(stub shim.ChaincodeStubInterface, id string) ([]byte, error) {
+	key, err := r.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	return stub.GetState(key)
+}
+
+func (r *DocRepository) upcastBytes(valAsbytes []byte) ([]byte, error) {
+	if SchemaVersion(r.DocType) == 1 {
+		return valAsbytes, nil
+	}
+	fields, err := unmarshalFields(valAsbytes)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := UpcastDoc(r.DocType, fields)
+	if err != nil || !changed {
+		return valAsbytes, err
+	}
+	return json.Marshal(fields)
+}
+
+// Get unmarshals a doc into doc, returns ErrDocNotExisted if it does not exist
+func (r *DocRepository) Get(stub shim.ChaincodeStubInterface, id string, doc interface{}) error {
+	valAsbytes, err := r.GetBytes(stub, id)
+	if err != nil {
+		return err
+	}
+	if valAsbytes == nil {
+		return ErrDocNotExisted
+	}
+	return json.Unmarshal(valAsbytes, doc)
+}
+
+// Insert stores a new doc and creates its index keys, returns ErrDocAlreadyExists if the id is taken
+func (r *DocRepository) Insert(stub shim.ChaincodeStubInterface, doc interface{}) error {
+	fields, docAsBytes, err := r.fields(doc)
+	if err != nil {
+		return err
+	}
+	id := docFieldString(fields, r.IdField)
+
+	oldAsBytes, err := r.getRawBytes(stub, id)
+	if err != nil {
+		return err
+	} else if oldAsBytes != nil {
+		return ErrDocAlreadyExists
+	}
+
+	err = r.putBytes(stub, id, docAsBytes)
+	if err != nil {
+		return err
+	}
+	for _, index := range r.Indexes {
+		err = r.putIndexKey(stub, index, fields, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update replaces an existing doc and moves the index keys whose fields changed,
+// returns ErrDocNotExisted if there is no doc to update
+func (r *DocRepository) Update(stub shim.ChaincodeStubInterface, doc interface{}) error {
+	fields, docAsBytes, err := r.fields(doc)
+	if err != nil {
+		return err
+	}
+	id := docFieldString(fields, r.IdField)
+
+	// the index keys on the ledger were built from the stored doc, not the upcast one
+	oldAsBytes, err := r.getRawBytes(stub, id)
+	if err != nil {
+		return err
+	} else if oldAsBytes == nil {
+		return ErrDocNotExisted
+	}
+	oldFields, err := unmarshalFields(oldAsBytes)
+	if err != nil {
+		return err
+	}
+
+	return r.replace(stub, id, oldFields, fields, docAsBytes)
+}
+
+// replace writes a doc over an existing one and moves the index keys whose fields changed
+func (r *DocRepository) replace(stub shim.ChaincodeStubInterface, id string, oldFields map[string]interface{}, fields map[string]interface{}, docAsBytes []byte) error {
+	err := r.putBytes(stub, id, docAsBytes)
+	if err != nil {
+		return err
+	}
+	for _, index := range r.Indexes {
+		if r.sameIndexValues(index, oldFields, fields) {
+			continue
+		}
+		err = r.delIndexKey(stub, index, oldFields, id)
+		if err != nil {
+			return err
+		}
+		err = r.putIndexKey(stub, index, fields, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate upcasts one stored doc, called by RunMigrationBatch for each key of the namespace
+func (r *DocRepository) migrate(stub shim.ChaincodeStubInterface, key string, valAsbytes []byte) error {
+	oldFields, err := unmarshalFields(valAsbytes)
+	if err != nil {
+		return errors.New("Failed to unmarshal doc " + key + ": " + err.Error())
+	}
+	fields, err := unmarshalFields(valAsbytes)
+	if err != nil {
+		return err
+	}
+	changed, err := UpcastDoc(r.DocType, fields)
+	if err != nil || !changed {
+		return err
+	}
+	docAsBytes, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return r.replace(stub, key[len(r.Namespace()):], oldFields, fields, docAsBytes)
+}
+
+// Delete removes a doc and its index keys, returns ErrDocNotExisted if there is no doc
+func (r *DocRepository) Delete(stub shim.ChaincodeStubInterface, id string) error {
+	// the index keys on the ledger were built from the stored doc, not the upcast one
+	oldAsBytes, err := r.getRawBytes(stub, id)
+	if err != nil {
+		return err
+	} else if oldAsBytes == nil {
+		return ErrDocNotExisted
+	}
+	oldFields, err := unmarshalFields(oldAsBytes)
+	if err != nil {
+		return err
+	}
+
+	key, _ := r.Key(id)
+	err = stub.DelState(key)
+	if err != nil {
+		return err
+	}
+	for _, index := range r.Indexes {
+		err = r.delIndexKey(stub, index, oldFields, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// =========================================================================================
+// QueryByIndex range scans an index by the leading field values and returns the
+// matching docs as a JSON array. Works on LevelDB as well as CouchDB.
+// =========================================================================================
+func (r *DocRepository) QueryByIndex(stub shim.ChaincodeStubInterface, indexName string, values []string) ([]byte, error) {
+	index, err := r.index(indexName)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) > len(index.Fields) {
+		return nil, errors.New("Too many values for index " + indexName)
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(r.indexObjectType(index), values)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attributes, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(attributes) != len(index.Fields)+1 {
+			return nil, errors.New("Malformed index key for " + indexName)
+		}
+
+		docAsBytes, err := r.GetBytes(stub, attributes[len(attributes)-1])
+		if err != nil {
+			return nil, err
+		}
+		if docAsBytes == nil {
+			continue
+		}
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(docAsBytes)
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	return buffer.Bytes(), nil
+}
+
+// CountByIndex counts the index keys starting with values, grouped by the index fields in groupBy
+func (r *DocRepository) CountByIndex(stub shim.ChaincodeStubInterface, indexName string, values []string, groupBy []string) (*AggregateResult, error) {
+	index, err := r.index(indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	groupByIdx := make([]int, len(groupBy))
+	for i, field := range groupBy {
+		groupByIdx[i] = -1
+		for j, indexField := range index.Fields {
+			if indexField == field {
+				groupByIdx[i] = j
+			}
+		}
+		if groupByIdx[i] < 0 {
+			return nil, errors.New("Field " + field + " is not in index " + indexName)
+		}
+	}
+
+	return CountCKeysWithNamespace(stub, r.Namespace(), index.Name, values, groupBy, groupByIdx)
+}
+
+// CountBySelector scans every doc of the repository, see CountDocsWithNamespace
+func (r *DocRepository) CountBySelector(stub shim.ChaincodeStubInterface, selector map[string]string, groupBy []string) (*AggregateResult, error) {
+	return CountDocsWithNamespace(stub, r.Namespace(), r.DocType, selector, groupBy)
+}
+
+func (r *DocRepository) History(stub shim.ChaincodeStubInterface, id string) ([]byte, error) {
+	_, err := r.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	return GetHistoryForDocWithNamespace(stub, r.Namespace(), id)
+}
+
+func (r *DocRepository) index(indexName string) (*DocIndex, error) {
+	for i := range r.Indexes {
+		if r.Indexes[i].Name == indexName {
+			return &r.Indexes[i], nil
+		}
+	}
+	return nil, errors.New("Unknown index " + indexName + " for docType " + r.DocType)
+}
+
+func (r *DocRepository) indexObjectType(index *DocIndex) string {
+	return r.Namespace() + index.Name
+}
+
+// fields marshals a doc stamped with the code schema version
+func (r *DocRepository) fields(doc interface{}) (map[string]interface{}, []byte, error) {
+	docAsBytes, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields, err := unmarshalFields(docAsBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields[SCHEMA_VERSION_FIELD] = SchemaVersion(r.DocType)
+	docAsBytes, err = json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fields, docAsBytes, nil
+}
+
+// unmarshalFields keeps numbers as json.Number so they survive a round trip unchanged
+func unmarshalFields(docAsBytes []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(docAsBytes))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	err := decoder.Decode(&fields)
+	if err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, errors.New("doc is not a JSON object")
+	}
+	return fields, nil
+}
+
+func (r *DocRepository) putBytes(stub shim.ChaincodeStubInterface, id string, docAsBytes []byte) error {
+	key, err := r.Key(id)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, docAsBytes)
+}
+
+func (r *DocRepository) indexValues(index DocIndex, fields map[string]interface{}, id string) []string {
+	values := make([]string, 0, len(index.Fields)+1)
+	for _, field := range index.Fields {
+		values = append(values, docFieldString(fields, field))
+	}
+	return append(values, id)
+}
+
+func (r *DocRepository) sameIndexValues(index DocIndex, oldFields map[string]interface{}, fields map[string]interface{}) bool {
+	for _, field := range index.Fields {
+		if docFieldString(oldFields, field) != docFieldString(fields, field) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *DocRepository) putIndexKey(stub shim.ChaincodeStubInterface, index DocIndex, fields map[string]interface{}, id string) error {
+	return CreateCKeyWithNamespace(stub, r.Namespace(), index.Name, r.indexValues(index, fields, id))
+}
+
+func (r *DocRepository) delIndexKey(stub shim.ChaincodeStubInterface, index DocIndex, fields map[string]interface{}, id string) error {
+	return DeleteCKeyWithNamespace(stub, r.Namespace(), index.Name, r.indexValues(index, fields, id))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"strings"
+)
+
+// Field encryption keeps selected doc fields as AES-GCM ciphertext in world state.
+// The key never reaches the ledger: clients pass it base64 encoded in the transient
+// field TRANSIENT_ENCRYPTION_KEY when they write such a field, and again when they
+// want the field decrypted in a response. The plaintext of an encrypted field does
+// not travel in the args either, which are part of the block, but in the transient
+// field TRANSIENT_USER_FIELDS.
+//
+// An encrypted value is the string ENCRYPTED_VALUE_PREFIX + keyId + ":" + base64(nonce|ciphertext).
+// Every endorser must compute the same ciphertext, so the nonce is not random but
+// an HMAC of tx ID, doc key, field and plaintext: unique per value, never reused
+// with another plaintext. The doc key and field are the GCM additional data, so a
+// ciphertext can not be moved to another doc or field.
+const (
+	TRANSIENT_ENCRYPTION_KEY string = "encryptionKey" // base64 AES key of 16, 24 or 32 bytes
+	TRANSIENT_USER_FIELDS    string = "userFields"    // JSON {userEmail: {field: plaintext}} of the encrypted UserInfo fields
+	ENCRYPTED_VALUE_PREFIX   string = "enc:v1:"
+	FIELD_NONCE_SIZE         int    = 12
+)
+
+var (
+	ErrEncryptionKeyRequired = errors.New("an encryption key must be passed in transient field " + TRANSIENT_ENCRYPTION_KEY)
+	ErrEncryptionKeyMismatch = errors.New("the encryption key does not match the one the data was encrypted with")
+)
+
+// GetTransientEncryptionKey returns nil when no key was passed
+func GetTransientEncryptionKey(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	keyBase64, ok := transient[TRANSIENT_ENCRYPTION_KEY]
+	if !ok {
+		return nil, nil
+	}
+	key, err := Base64Decoding(string(keyBase64))
+	if err != nil || (len(key) != 16 && len(key) != 24 && len(key) != 32) {
+		return nil, errors.New(TRANSIENT_ENCRYPTION_KEY + " must be a base64 AES key of 16, 24 or 32 bytes")
+	}
+	return key, nil
+}
+
+// encryptionKeyId tells keys apart without revealing them
+func encryptionKeyId(key []byte) string {
+	return hex.EncodeToString(ComputeHmac256Bytes([]byte("key id"), key)[:4])
+}
+
+func fieldAdditionalData(docKey string, field string) []byte {
+	return []byte(docKey + "\x00" + field)
+}
+
+func IsEncryptedFieldValue(value string) bool {
+	return strings.HasPrefix(value, ENCRYPTED_VALUE_PREFIX)
+}
+
+func EncryptFieldValue(stub shim.ChaincodeStubInterface, key []byte, docKey string, field string, plaintext string) (string, error) {
+	nonceKey := ComputeHmac256Bytes([]byte("field nonce"), key)
+	nonceInput := strings.Join([]string{stub.GetTxID(), docKey, field, plaintext}, "\x00")
+	nonce := ComputeHmac256Bytes([]byte(nonceInput), nonceKey)[:FIELD_NONCE_SIZE]
+
+	ciphertext, err := EncryptAESGCM(key, nonce, []byte(plaintext), fieldAdditionalData(docKey, field))
+	if err != nil {
+		return "", err
+	}
+	return ENCRYPTED_VALUE_PREFIX + encryptionKeyId(key) + ":" + Base64Encoding(append(nonce, ciphertext...)), nil
+}
+
+func DecryptFieldValue(key []byte, docKey string, field string, value string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(value, ENCRYPTED_VALUE_PREFIX), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("Malformed encrypted value of " + field)
+	}
+	if parts[0] != encryptionKeyId(key) {
+		return "", ErrEncryptionKeyMismatch
+	}
+	sealed, err := Base64Decoding(parts[1])
+	if err != nil || len(sealed) < FIELD_NONCE_SIZE {
+		return "", errors.New("Malformed encrypted value of " + field)
+	}
+	plaintext, err := DecryptAESGCM(key, sealed[:FIELD_NONCE_SIZE], sealed[FIELD_NONCE_SIZE:], fieldAdditionalData(docKey, field))
+	if err != nil {
+		return "", errors.New("Failed to decrypt " + field + " of " + docKey + ": " + err.Error())
+	}
+	return string(plaintext), nil
+}
+
+// =========================================================================================
+// DecryptDocsJSON decrypts the encrypted fields of every doc of a repository found in a
+// JSON value: a doc, an array of docs, history records... Other values are kept as is.
+// =========================================================================================
+func DecryptDocsJSON(key []byte, repo *DocRepository, docsJSON []byte) ([]byte, error) {
+	if docsJSON == nil {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(docsJSON))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	err = decryptDocsValue(key, repo, value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+func decryptDocsValue(key []byte, repo *DocRepository, value interface{}) error {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			err := decryptDocsValue(key, repo, item)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		id, isDoc := v[repo.IdField].(string)
+		if v["docType"] != repo.DocType || !isDoc {
+			for _, item := range v {
+				err := decryptDocsValue(key, repo, item)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		docKey, err := repo.Key(id)
+		if err != nil {
+			return err
+		}
+		for field, fieldValue := range v {
+			str, ok := fieldValue.(string)
+			if !ok || !IsEncryptedFieldValue(str) {
+				continue
+			}
+			v[field], err = DecryptFieldValue(key, docKey, field, str)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The balances of UserInfo accounts are held by the example02 chaincode named in the
+// setting ledgerChaincode, under an entity named by the userEmail. The demo reads them
+// with InvokeChaincode; on the same channel the read is part of the transaction and is
+// validated like any other read, on another channel (setting ledgerChannel) it is not.
+//
+// Anyone can create an example02 entity under any name, so the entity only counts as
+// the user's while its owner is the account bound by BindUserLedgerAccount; any other
+// entity is foreign, it is reported but does not keep the user from being deleted.
+//
+// example02 answers {"code","version","data","error"} with the same codes as PbResponse;
+// codes that mean the same pass through, any other failure is RESP_CODE_SYSTEM_ERROR.
+const (
+	LEDGER_FUNCTION_QUERY string = "query"
+	LEDGER_CODE_SUCCESS   string = "1000"
+	READ_WITH_BALANCE     string = "withBalance" // 2nd argument of ReadUserInfo
+	FD_LEDGER_BALANCE     string = "ledgerBalance"
+)
+
+var ledgerPassThroughCodes = map[string]bool{
+	RESP_CODE_ARGUMENTS_ERROR:    true,
+	RESP_CODE_DATA_ALREADY_EXIST: true,
+	RESP_CODE_DATA_NOT_EXISTED:   true,
+	RESP_CODE_PERMISSION_DENIED:  true,
+	RESP_CODE_INSUFFICIENT_FUNDS: true,
+	RESP_CODE_INVALID_STATE:      true,
+}
+
+// LedgerResponse is the response envelope of example02
+type LedgerResponse struct {
+	Code    string          `json:"code"`
+	Version string          `json:"version"`
+	Data    json.RawMessage `json:"data"`
+	Error   string          `json:"error"`
+}
+
+// LedgerBalance is the data of the example02 query
+type LedgerBalance struct {
+	Name    string `json:"name"`
+	Amount  string `json:"amount"` // decimal string, e.g. "12.50"
+	Owner   string `json:"owner"`
+	Foreign bool   `json:"foreign,omitempty"` // owned by another account than the one bound to the UserInfo, set by GetUserLedgerBalance
+}
+
+// IsZero tells whether the decimal amount is 0, "0.00" included
+func (b *LedgerBalance) IsZero() bool {
+	return strings.Trim(b.Amount, "0.") == ""
+}
+
+// LedgerError is a failed call to the ledger chaincode with its PbResponse code
+type LedgerError struct {
+	Code    string
+	Message string
+}
+
+func (e *LedgerError) Error() string {
+	return e.Message
+}
+
+// ==== LedgerConfigured tells whether a ledger chaincode is set
+func LedgerConfigured(stub shim.ChaincodeStubInterface) (bool, error) {
+	chaincodeName, err := GetConfigString(stub, CFG_LEDGER_CHAINCODE)
+	return chaincodeName != "", err
+}
+
+// ==== invokeLedger calls a function of the ledger chaincode and returns the data of its answer
+func invokeLedger(stub shim.ChaincodeStubInterface, args []string) (json.RawMessage, error) {
+	chaincodeName, err := GetConfigString(stub, CFG_LEDGER_CHAINCODE)
+	if err != nil {
+		return nil, err
+	}
+	if chaincodeName == "" {
+		return nil, &LedgerError{RESP_CODE_ARGUMENTS_ERROR, "setting " + CFG_LEDGER_CHAINCODE + " is not set"}
+	}
+	channel, err := GetConfigString(stub, CFG_LEDGER_CHANNEL)
+	if err != nil {
+		return nil, err
+	}
+
+	invokeArgs := make([][]byte, len(args))
+	for i, arg := range args {
+		invokeArgs[i] = []byte(arg)
+	}
+	response := stub.InvokeChaincode(chaincodeName, invokeArgs, channel)
+
+	// example02 puts the envelope in the payload and in the message of failures, the
+	// peer may pass on only the message; errors of the peer itself are plain text
+	var ledgerResponse LedgerResponse
+	err = json.Unmarshal(response.Payload, &ledgerResponse)
+	if err != nil || ledgerResponse.Code == "" {
+		err = json.Unmarshal([]byte(response.Message), &ledgerResponse)
+	}
+	if err != nil || ledgerResponse.Code == "" {
+		return nil, &LedgerError{RESP_CODE_SYSTEM_ERROR, fmt.Sprintf("ledger chaincode %s failed with status %d: %s", chaincodeName, response.Status, response.Message)}
+	}
+	if ledgerResponse.Code != LEDGER_CODE_SUCCESS {
+		code := RESP_CODE_SYSTEM_ERROR
+		if ledgerPassThroughCodes[ledgerResponse.Code] {
+			code = ledgerResponse.Code
+		}
+		return nil, &LedgerError{code, "ledger chaincode " + chaincodeName + ": " + ledgerResponse.Error}
+	}
+	return ledgerResponse.Data, nil
+}
+
+// ==== GetLedgerBalance reads the balance of an entity, nil if the ledger has no such entity
+func GetLedgerBalance(stub shim.ChaincodeStubInterface, entity string) (*LedgerBalance, error) {
+	data, err := invokeLedger(stub, []string{LEDGER_FUNCTION_QUERY, entity})
+	if ledgerErr, ok := err.(*LedgerError); ok && ledgerErr.Code == RESP_CODE_DATA_NOT_EXISTED {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	balance := &LedgerBalance{}
+	err = json.Unmarshal(data, balance)
+	if err != nil {
+		return nil, &LedgerError{RESP_CODE_SYSTEM_ERROR, "malformed answer of the ledger chaincode: " + err.Error()}
+	}
+	return balance, nil
+}
+
+// ==== GetUserLedgerBalance reads the balance of the entity of a user and tells whether another account owns it.
+// ==== A user without a bound account counts as owning its entity, so an unbound user can not skip the balance check.
+func GetUserLedgerBalance(stub shim.ChaincodeStubInterface, userInfo *UserInfo) (*LedgerBalance, error) {
+	balance, err := GetLedgerBalance(stub, userInfo.UserEmail)
+	if balance != nil {
+		balance.Foreign = userInfo.UserLedgerAccount != "" && balance.Owner != userInfo.UserLedgerAccount
+	}
+	return balance, err
+}
+
+// ==== IsLedgerAccount tells whether account looks like an example02 account "<MSP ID>/<enrollment ID>"
+func IsLedgerAccount(account string) bool {
+	parts := strings.SplitN(account, "/", 2)
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+// ==== LedgerErrorPbResponse answers a failed ledger call with the code of the LedgerError
+func LedgerErrorPbResponse(err error) pb.Response {
+	if ledgerErr, ok := err.(*LedgerError); ok {
+		return ErrorPbResponse(ledgerErr.Code, ledgerErr.Message)
+	}
+	return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log entries are JSON lines on stdout, tagged with the channel, tx ID and function
+// of the stub they are logged for:
+//
+//	{"ts":"...","level":"info","channel":"mychannel","txId":"...","function":"InitUserInfo","msg":"...","fields":{...}}
+//
+// The level is the config setting logLevel, or the environment variable
+// ENV_LOG_LEVEL when the setting is empty, or info. Reading the config for every
+// transaction would put it in every read set, and any UpdateConfig would invalidate
+// the transactions in flight, so the setting is taken from the last config a
+// transaction of this peer read anyway (see getConfigDoc); a change applies once a
+// function that reads the config runs. Fields whose name looks
+// sensitive (see sensitiveLogFieldParts) are logged as LOG_REDACTED, also inside
+// nested values.
+const (
+	LOG_LEVEL_DEBUG   string = "debug"
+	LOG_LEVEL_INFO    string = "info"
+	LOG_LEVEL_WARNING string = "warning"
+	LOG_LEVEL_ERROR   string = "error"
+
+	ENV_LOG_LEVEL string = "DEMO_LOG_LEVEL"
+	LOG_REDACTED  string = "***"
+)
+
+// LogFields are the structured data of a log entry
+type LogFields map[string]interface{}
+
+var logLevels = map[string]int{LOG_LEVEL_DEBUG: 0, LOG_LEVEL_INFO: 1, LOG_LEVEL_WARNING: 2, LOG_LEVEL_ERROR: 3}
+
+// lower cased parts of field names that are never logged in clear
+var sensitiveLogFieldParts = []string{"pwd", "password", "secret", "token", "privatekey"}
+
+var (
+	logOutput   io.Writer = os.Stdout
+	logMutex    sync.Mutex
+	envLogLevel = os.Getenv(ENV_LOG_LEVEL)
+	// setting logLevel of the last config read, the shim runs transactions concurrently
+	configLogLevel atomic.Value
+)
+
+// setConfigLogLevel records the setting logLevel of a config that was read
+func setConfigLogLevel(level string) {
+	configLogLevel.Store(level)
+}
+
+func logLevel() string {
+	if level, ok := configLogLevel.Load().(string); ok && level != "" {
+		return level
+	}
+	if _, ok := logLevels[envLogLevel]; ok {
+		return envLogLevel
+	}
+	return LOG_LEVEL_INFO
+}
+
+func LogDebug(stub shim.ChaincodeStubInterface, msg string, fields ...LogFields) {
+	logEntry(stub, LOG_LEVEL_DEBUG, msg, fields)
+}
+
+func LogInfo(stub shim.ChaincodeStubInterface, msg string, fields ...LogFields) {
+	logEntry(stub, LOG_LEVEL_INFO, msg, fields)
+}
+
+func LogWarning(stub shim.ChaincodeStubInterface, msg string, fields ...LogFields) {
+	logEntry(stub, LOG_LEVEL_WARNING, msg, fields)
+}
+
+func LogError(stub shim.ChaincodeStubInterface, msg string, fields ...LogFields) {
+	logEntry(stub, LOG_LEVEL_ERROR, msg, fields)
+}
+
+// logEntry writes one JSON line, stub may be nil outside of a transaction
+func logEntry(stub shim.ChaincodeStubInterface, level string, msg string, fields []LogFields) {
+	if logLevels[level] < logLevels[logLevel()] {
+		return
+	}
+
+	entry := make(map[string]interface{})
+	entry["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	if stub != nil {
+		function, _ := stub.GetFunctionAndParameters()
+		entry["channel"] = stub.GetChannelID()
+		entry["txId"] = stub.GetTxID()
+		entry["function"] = function
+	}
+	entry["msg"] = msg
+	if len(fields) > 0 {
+		merged := make(map[string]interface{})
+		for _, f := range fields {
+			for name, value := range f {
+				merged[name] = value
+			}
+		}
+		entry["fields"] = redactLogValue(merged)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"level":"error","msg":"unloggable entry: %s"}`, strings.Replace(err.Error(), `"`, `'`, -1)))
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	logOutput.Write(append(line, '\n'))
+}
+
+func isSensitiveLogField(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range sensitiveLogFieldParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactLogValue replaces sensitive fields, structs are redacted by their JSON names
+func redactLogValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, string, bool, int, int64, float64, json.Number:
+		return v
+	case error:
+		return v.Error()
+	case []byte:
+		return string(v)
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for name, fieldValue := range v {
+			if isSensitiveLogField(name) {
+				redacted[name] = LOG_REDACTED
+			} else {
+				redacted[name] = redactLogValue(fieldValue)
+			}
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i := range v {
+			redacted[i] = redactLogValue(v[i])
+		}
+		return redacted
+	}
+
+	// structs, typed maps and slices: redact their JSON form
+	valueAsBytes, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%+v", value)
+	}
+	var generic interface{}
+	err = json.Unmarshal(valueAsBytes, &generic)
+	if err != nil {
+		return string(valueAsBytes)
+	}
+	return redactLogValue(generic)
+}
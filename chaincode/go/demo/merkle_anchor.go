@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/examples/chaincode/go/hashutil"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+)
+
+// A Merkle anchor notarizes a batch of document digests with one key: the digests are
+// the leaves of a Merkle tree built off-chain and only its root and leaf count are stored.
+// A digest is then proven part of the batch with its leaf index and the audit path.
+//
+// The tree is the one of RFC 6962 (Certificate Transparency), with SHA-256:
+//
+//	leaf hash = SHA-256(0x00 | document SHA-256)
+//	node hash = SHA-256(0x01 | left | right)
+//
+// leaves in order, a last odd subtree is promoted as is, not duplicated. The prefixes
+// keep a node from passing for a leaf.
+const (
+	DT_MERKLE_ANCHOR    string = "merkleAnchor"
+	NS_MERKLE_ANCHOR    string = DT_MERKLE_ANCHOR + "_"
+	PK_FD_MERKLE_ANCHOR string = "merkleRoot"
+
+	MERKLE_LEAF_PREFIX    byte  = 0x00
+	MERKLE_NODE_PREFIX    byte  = 0x01
+	MAX_MERKLE_PROOF_SIZE int   = 40
+	MAX_MERKLE_LEAVES     int64 = 1 << uint(MAX_MERKLE_PROOF_SIZE) // trees with audit paths of at most MAX_MERKLE_PROOF_SIZE hashes
+)
+
+type MerkleAnchorMng struct{}
+
+// merkleAnchorRepo stores MerkleAnchor under NS_MERKLE_ANCHOR
+var merkleAnchorRepo = NewDocRepository(DT_MERKLE_ANCHOR, PK_FD_MERKLE_ANCHOR)
+
+type MerkleAnchor struct {
+	DocType    string          `json:"docType"`            //merkleAnchor
+	MerkleRoot string          `json:"merkleRoot"`         //Merkle根, 小写十六进制
+	LeafCount  int64           `json:"leafCount"`          //叶子数
+	Metadata   json.RawMessage `json:"metadata,omitempty"` //批次元数据, JSON对象
+	MspId      string          `json:"mspId"`              //提交者MSP
+	TxId       string          `json:"txId"`
+	Timestamp  int64           `json:"timestamp"` //交易时间, unix seconds
+}
+
+// MerkleInclusionCheck is the answer of VerifyMerkleInclusion
+type MerkleInclusionCheck struct {
+	Included  bool          `json:"included"`
+	DocHash   string        `json:"docHash"`
+	LeafIndex int64         `json:"leafIndex"`
+	Anchor    *MerkleAnchor `json:"anchor"`
+}
+
+func init() {
+	RegisterRouter(new(MerkleAnchorMng))
+}
+
+// Route dispatches the MerkleAnchor functions for DomoChaincode.Invoke
+func (t *MerkleAnchorMng) Route(stub shim.ChaincodeStubInterface, function string, args []string) (pb.Response, bool) {
+	switch function {
+	case "AnchorMerkleRoot":
+		return t.AnchorMerkleRoot(stub, args), true
+	case "ReadMerkleAnchor":
+		return t.ReadMerkleAnchor(stub, args), true
+	case "VerifyMerkleInclusion":
+		return t.VerifyMerkleInclusion(stub, args), true
+	}
+	return pb.Response{}, false
+}
+
+// MerkleLeafHash is the tree leaf of a document SHA-256
+func MerkleLeafHash(docHash []byte) []byte {
+	return ComputeSHA256Bytes(string(append([]byte{MERKLE_LEAF_PREFIX}, docHash...)))
+}
+
+// MerkleNodeHash is the parent of two tree nodes
+func MerkleNodeHash(left []byte, right []byte) []byte {
+	node := append([]byte{MERKLE_NODE_PREFIX}, left...)
+	return ComputeSHA256Bytes(string(append(node, right...)))
+}
+
+// =========================================================================================
+// VerifyMerkleInclusionProof checks the audit path of leaf leafIndex of a tree of leafCount
+// leaves, proof lists the sibling hashes from the leaf up (RFC 9162, 2.1.3.2)
+// =========================================================================================
+func VerifyMerkleInclusionProof(root []byte, leafCount int64, leafIndex int64, docHash []byte, proof [][]byte) bool {
+	if leafIndex < 0 || leafIndex >= leafCount {
+		return false
+	}
+	fn, sn := leafIndex, leafCount-1
+	hash := MerkleLeafHash(docHash)
+	for _, sibling := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			hash = MerkleNodeHash(sibling, hash)
+			// skip the levels where the node is promoted without a sibling
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			hash = MerkleNodeHash(hash, sibling)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(hash, root)
+}
+
+// parseMerkleProof reads a JSON array of SHA-256, hex or base64
+func parseMerkleProof(proofJSON string) ([][]byte, error) {
+	var hashes []string
+	err := json.Unmarshal([]byte(proofJSON), &hashes)
+	if err != nil {
+		return nil, errors.New("expecting a JSON array of hashes")
+	}
+	if len(hashes) > MAX_MERKLE_PROOF_SIZE {
+		return nil, errors.New("expecting at most " + strconv.Itoa(MAX_MERKLE_PROOF_SIZE) + " hashes")
+	}
+	proof := make([][]byte, len(hashes))
+	for i, hash := range hashes {
+		normalized, err := hashutil.NormalizeSHA256(hash)
+		if err != nil {
+			return nil, errors.New("hash " + strconv.Itoa(i) + ": " + err.Error())
+		}
+		proof[i], _ = hex.DecodeString(normalized)
+	}
+	return proof, nil
+}
+
+// ============================================================
+// AnchorMerkleRoot - store the root of a batch of document digests
+//
+// Inputs - Array of strings
+//  0                   1            2
+//  merkleRoot          leafCount    metadata, optional JSON object
+//  "<hex or base64>"   "100000"     "{\"batch\":\"2018-06-30\"}"
+// ============================================================
+func (t *MerkleAnchorMng) AnchorMerkleRoot(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 || len(args) > 3 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	// ==== Input sanitation ====
+	merkleRoot, err := hashutil.NormalizeSHA256(args[0])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument: "+err.Error())
+	}
+	leafCount, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || leafCount <= 0 || leafCount > MAX_MERKLE_LEAVES {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "2nd argument must be a leaf count from 1 to "+strconv.FormatInt(MAX_MERKLE_LEAVES, 10))
+	}
+	var metadata json.RawMessage
+	if len(args) == 3 {
+		metadata, err = CompactJSONObject(args[2])
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "3rd argument "+err.Error())
+		}
+	}
+
+	mspID, err := GetCallerMSPID(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, "Failed to get caller MSP ID: "+err.Error())
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	anchor := MerkleAnchor{DT_MERKLE_ANCHOR, merkleRoot, leafCount, metadata, mspID, stub.GetTxID(), txTimestamp.Seconds}
+	err = merkleAnchorRepo.Insert(stub, &anchor)
+	if err == ErrDocAlreadyExists {
+		return ErrorPbResponse(RESP_CODE_DATA_ALREADY_EXIST, "This Merkle root is already anchored: "+merkleRoot)
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	LogInfo(stub, "end AnchorMerkleRoot", LogFields{"merkleRoot": merkleRoot, "leafCount": leafCount})
+	anchorAsBytes, err := json.Marshal(anchor)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(anchorAsBytes)
+}
+
+// ============================================================
+// ReadMerkleAnchor - read an anchored Merkle root
+// ============================================================
+func (t *MerkleAnchorMng) ReadMerkleAnchor(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting merkleRoot")
+	}
+	merkleRoot, err := hashutil.NormalizeSHA256(args[0])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument: "+err.Error())
+	}
+
+	valAsbytes, err := merkleAnchorRepo.GetBytes(stub, merkleRoot)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if valAsbytes == nil {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "Merkle root is not anchored: "+merkleRoot)
+	}
+	return SuccessPbResponse(valAsbytes)
+}
+
+// ============================================================
+// VerifyMerkleInclusion - check that a document digest is a leaf of an anchored root
+//
+// Inputs - Array of strings
+//  0                   1                   2            3
+//  merkleRoot          docHash             leafIndex    proof, sibling hashes from the leaf up
+//  "<hex or base64>"   "<hex or base64>"   "41"         "[\"<hex>\",\"<hex>\"]"
+//
+// Returns - MerkleInclusionCheck, included false when the proof does not match
+// ============================================================
+func (t *MerkleAnchorMng) VerifyMerkleInclusion(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 4")
+	}
+
+	// ==== Input sanitation ====
+	merkleRoot, err := hashutil.NormalizeSHA256(args[0])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument: "+err.Error())
+	}
+	docHash, err := hashutil.NormalizeSHA256(args[1])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "2nd argument: "+err.Error())
+	}
+	leafIndex, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || leafIndex < 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "3rd argument must be a leaf index from 0")
+	}
+	proof, err := parseMerkleProof(args[3])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "4th argument: "+err.Error())
+	}
+
+	anchor := MerkleAnchor{}
+	err = merkleAnchorRepo.Get(stub, merkleRoot, &anchor)
+	if err == ErrDocNotExisted {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "Merkle root is not anchored: "+merkleRoot)
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	rootBytes, _ := hex.DecodeString(merkleRoot)
+	docHashBytes, _ := hex.DecodeString(docHash)
+	check := MerkleInclusionCheck{
+		Included:  VerifyMerkleInclusionProof(rootBytes, anchor.LeafCount, leafIndex, docHashBytes, proof),
+		DocHash:   docHash,
+		LeafIndex: leafIndex,
+		Anchor:    &anchor,
+	}
+	checkAsBytes, err := json.Marshal(check)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(checkAsBytes)
+}
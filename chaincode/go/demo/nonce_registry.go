@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Used nonces are kept per signer under [signerId, nonce] until they expire.
+// A signed request carries its own timestamp, which must be within nonceTtl seconds
+// of the tx timestamp; a nonce therefore expires 2*nonceTtl after the tx timestamp,
+// when a replay of the request is too old to be accepted anyway.
+//
+// A second key [expiresAt, signerId, nonce] orders the nonces by expiry, so
+// PruneRequestNonces only scans what it deletes. The client sets the tx timestamp,
+// so pruning keeps a further nonceTtl of nonces: a proposal dated ahead of the
+// peers' clocks by up to nonceTtl can not remove nonces that are still live.
+//
+// A backdated proposal could still bring a pruned request back into the window, so
+// pruning records its cutoff under KEY_NONCE_WATERMARK and request timestamps at or
+// below it are rejected: a pruned request is older than the cutoff by nonceTtl.
+const (
+	DT_REQUEST_NONCE        string = "requestNonce"       // composite key [signerId, nonce]
+	DT_REQUEST_NONCE_EXPIRY string = "requestNonceExpiry" // composite key [expiresAt, signerId, nonce]
+	KEY_NONCE_WATERMARK     string = NS_RESERVED + "nonceWatermark" // unix seconds, the highest prune cutoff
+	NONCE_TTL               int    = 300                  // default of setting nonceTtl, seconds
+	NONCE_PRUNE_SIZE        int    = 1000                 // nonces deleted per PruneRequestNonces by default
+)
+
+// NonceRecord is stored for every accepted signed request
+type NonceRecord struct {
+	Signer    string `json:"signer"`
+	Nonce     string `json:"nonce"`
+	Function  string `json:"function"`
+	Signature string `json:"signature"`
+	Timestamp int64  `json:"timestamp"` // of the request, unix seconds
+	ExpiresAt int64  `json:"expiresAt"` // unix seconds
+	TxId      string `json:"txId"`
+}
+
+var (
+	errNonceUsed    = errors.New("nonce already used")
+	errNonceExpired = errors.New("request timestamp out of the accepted window")
+)
+
+// expiry keys sort by time, so the seconds are zero padded
+func nonceExpiryAttribute(expiresAt int64) string {
+	return fmt.Sprintf("%012d", expiresAt)
+}
+
+// PutRequestNonce records the nonce of an accepted request, errNonceUsed if the signer used
+// it before and errNonceExpired if the request timestamp is too far from the tx timestamp
+func PutRequestNonce(stub shim.ChaincodeStubInterface, auth *RequestAuth, function string) error {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	ttl, err := GetConfigInt(stub, CFG_NONCE_TTL)
+	if err != nil {
+		return err
+	}
+	if auth.Timestamp < txTimestamp.Seconds-int64(ttl) || auth.Timestamp > txTimestamp.Seconds+int64(ttl) {
+		return errNonceExpired
+	}
+	watermark, err := getNonceWatermark(stub)
+	if err != nil {
+		return err
+	}
+	if auth.Timestamp <= watermark {
+		return errNonceExpired
+	}
+
+	nonceKey, err := stub.CreateCompositeKey(DT_REQUEST_NONCE, []string{auth.Signer, auth.Nonce})
+	if err != nil {
+		return err
+	}
+	valAsbytes, err := stub.GetState(nonceKey)
+	if err != nil {
+		return err
+	} else if valAsbytes != nil {
+		return errNonceUsed
+	}
+
+	expiresAt := txTimestamp.Seconds + 2*int64(ttl)
+	record := NonceRecord{auth.Signer, auth.Nonce, function, auth.Signature, auth.Timestamp, expiresAt, stub.GetTxID()}
+	valAsbytes, err = json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(nonceKey, valAsbytes)
+	if err != nil {
+		return err
+	}
+
+	expiryKey, err := stub.CreateCompositeKey(DT_REQUEST_NONCE_EXPIRY, []string{nonceExpiryAttribute(expiresAt), auth.Signer, auth.Nonce})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(expiryKey, []byte{0x00})
+}
+
+// getNonceWatermark returns the highest cutoff of PruneRequestNonces, 0 before the first
+func getNonceWatermark(stub shim.ChaincodeStubInterface) (int64, error) {
+	valAsbytes, err := stub.GetState(KEY_NONCE_WATERMARK)
+	if err != nil || valAsbytes == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(valAsbytes), 10, 64)
+}
+
+// =========================================================================================
+// PruneRequestNonces deletes at most max nonces that expired nonceTtl before the tx
+// timestamp, oldest first, returns how many were deleted
+// =========================================================================================
+func PruneRequestNonces(stub shim.ChaincodeStubInterface, max int) (int, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	ttl, err := GetConfigInt(stub, CFG_NONCE_TTL)
+	if err != nil {
+		return 0, err
+	}
+	before := txTimestamp.Seconds - int64(ttl)
+	cutoff := nonceExpiryAttribute(before)
+
+	// ==== requests pruned now must not come back with a backdated proposal ====
+	watermark, err := getNonceWatermark(stub)
+	if err != nil {
+		return 0, err
+	}
+	if before > watermark {
+		err = stub.PutState(KEY_NONCE_WATERMARK, []byte(strconv.FormatInt(before, 10)))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(DT_REQUEST_NONCE_EXPIRY, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	pruned := 0
+	for pruned < max && resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return pruned, err
+		}
+		_, attributes, err := stub.SplitCompositeKey(queryResponse.Key)
+		if err != nil {
+			return pruned, err
+		}
+		if len(attributes) != 3 {
+			return pruned, errors.New("Malformed nonce expiry key: " + queryResponse.Key)
+		}
+		if attributes[0] >= cutoff {
+			break
+		}
+
+		nonceKey, err := stub.CreateCompositeKey(DT_REQUEST_NONCE, attributes[1:])
+		if err != nil {
+			return pruned, err
+		}
+		err = stub.DelState(nonceKey)
+		if err != nil {
+			return pruned, err
+		}
+		err = stub.DelState(queryResponse.Key)
+		if err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+
+	LogInfo(stub, "request nonces pruned", LogFields{"pruned": pruned, "before": before})
+	return pruned, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/examples/chaincode/go/hashutil"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Notarization registers the SHA-256 of a document, with its owner, as proof that
+// the document existed at the transaction time. The document itself stays off-chain;
+// a digest can be registered once, the first registration is the proof.
+//
+// Only the owner can register a document, by signing the request as "user:" +
+// ownerEmail (see request_auth.go), or an admin on the owner's behalf. The Fabric identity
+// that submitted the registration is recorded as NotarizedBy.
+//
+// Digests are passed as 64 hex characters (sha256sum) or as base64 of the 32 bytes
+// (openssl dgst -sha256 -binary | base64) and stored as lower case hex.
+const (
+	DT_NOTARIZATION            string = "notarization"
+	NS_NOTARIZATION            string = DT_NOTARIZATION + "_"
+	PK_FD_NOTARIZATION         string = "docHash"
+	IDX_FD_OWNER_EMAIL         string = "ownerEmail"
+	IDX_OWNER_EMAIL_2_DOC_HASH string = IDX_FD_OWNER_EMAIL + "_2_" + PK_FD_NOTARIZATION
+)
+
+type NotarizationMng struct{}
+
+// notarizationRepo stores Notarization under NS_NOTARIZATION and keeps ownerEmail_2_docHash
+var notarizationRepo = NewDocRepository(DT_NOTARIZATION, PK_FD_NOTARIZATION, DocIndex{IDX_OWNER_EMAIL_2_DOC_HASH, []string{IDX_FD_OWNER_EMAIL}})
+
+type Notarization struct {
+	DocType     string          `json:"docType"`            //notarization
+	DocHash     string          `json:"docHash"`            //文档SHA-256, 小写十六进制
+	OwnerEmail  string          `json:"ownerEmail"`         //所有者邮箱, 见UserInfo
+	Metadata    json.RawMessage `json:"metadata,omitempty"` //文档元数据, JSON对象
+	TxId        string          `json:"txId"`
+	Timestamp   int64           `json:"timestamp"`             //交易时间, unix seconds
+	NotarizedBy string          `json:"notarizedBy,omitempty"` //提交者, "<MSP ID>/<enrollment ID>"
+}
+
+// NotarizationCheck is the answer of the Verify functions
+type NotarizationCheck struct {
+	Notarized    bool          `json:"notarized"`
+	DocHash      string        `json:"docHash"`
+	Notarization *Notarization `json:"notarization,omitempty"`
+}
+
+func init() {
+	RegisterRouter(new(NotarizationMng))
+}
+
+// Route dispatches the Notarization functions for DomoChaincode.Invoke
+func (t *NotarizationMng) Route(stub shim.ChaincodeStubInterface, function string, args []string) (pb.Response, bool) {
+	switch function {
+	case "NotarizeDocument":
+		return t.NotarizeDocument(stub, args), true
+	case "VerifyNotarization":
+		return t.VerifyNotarization(stub, args), true
+	case "VerifyDocumentContent":
+		return t.VerifyDocumentContent(stub, args), true
+	case "QueryNotarizationsByOwner":
+		return t.QueryNotarizationsByOwner(stub, args), true
+	}
+	return pb.Response{}, false
+}
+
+// ============================================================
+// NotarizeDocument - register the digest of a document for a user
+//
+// Inputs - Array of strings
+//  0               1                 2
+//  ownerEmail      docHash           metadata, optional JSON object
+//  "a@test.com"    "9f86d08..."      "{\"name\":\"contract.pdf\"}"
+// ============================================================
+func (t *NotarizationMng) NotarizeDocument(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 || len(args) > 3 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 2 or 3")
+	}
+
+	// ==== Input sanitation ====
+	if len(args[0]) <= 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument must be a non-empty string")
+	}
+	docHash, err := hashutil.NormalizeSHA256(args[1])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "2nd argument: "+err.Error())
+	}
+	var metadata json.RawMessage
+	if len(args) == 3 {
+		metadata, err = CompactJSONObject(args[2])
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "3rd argument "+err.Error())
+		}
+	}
+
+	// ==== the owner must be an active user ====
+	owner := UserInfo{}
+	err = userInfoRepo.Get(stub, args[0], &owner)
+	if err == ErrDocNotExisted || (err == nil && owner.UserStatus == ST_COMM_NILED) {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "UserInfo does not exist: "+args[0])
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	// ==== the owner signs the request, or an admin registers for the owner ====
+	signer, err := AuthenticatedSigner(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	if signer != SIGNER_PREFIX_USER+args[0] {
+		isAdmin, err := IsAdmin(stub)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		} else if !isAdmin {
+			return ErrorPbResponse(RESP_CODE_PERMISSION_DENIED, "Only "+SIGNER_PREFIX_USER+args[0]+" or an admin may notarize for "+args[0])
+		}
+	}
+	caller, err := GetCallerIdentity(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	notarization := Notarization{DT_NOTARIZATION, docHash, args[0], metadata, stub.GetTxID(), txTimestamp.Seconds, caller}
+	err = notarizationRepo.Insert(stub, &notarization)
+	if err == ErrDocAlreadyExists {
+		return ErrorPbResponse(RESP_CODE_DATA_ALREADY_EXIST, "This document is already notarized: "+docHash)
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	LogInfo(stub, "end NotarizeDocument", LogFields{"docHash": docHash, "ownerEmail": args[0]})
+	notarizationAsBytes, err := json.Marshal(notarization)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(notarizationAsBytes)
+}
+
+// ============================================================
+// VerifyNotarization - tell whether a digest was notarized, when and by whom
+//
+// Inputs - Array of strings
+//  0
+//  docHash, hex or base64
+//  "9f86d08..."
+//
+// Returns - NotarizationCheck, notarized false when the digest is unknown
+// ============================================================
+func (t *NotarizationMng) VerifyNotarization(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting docHash")
+	}
+	docHash, err := hashutil.NormalizeSHA256(args[0])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument: "+err.Error())
+	}
+	return t.checkNotarization(stub, docHash)
+}
+
+// ============================================================
+// VerifyDocumentContent - VerifyNotarization of the SHA-256 of a small document
+// passed as is
+//
+// Inputs - Array of strings
+//  0
+//  content
+//  "hello world"
+// ============================================================
+func (t *NotarizationMng) VerifyDocumentContent(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting content")
+	}
+	return t.checkNotarization(stub, hashutil.SHA256Hex(args[0]))
+}
+
+func (t *NotarizationMng) checkNotarization(stub shim.ChaincodeStubInterface, docHash string) pb.Response {
+	check := NotarizationCheck{DocHash: docHash}
+	notarization := Notarization{}
+	err := notarizationRepo.Get(stub, docHash, &notarization)
+	if err == nil {
+		check.Notarized = true
+		check.Notarization = &notarization
+	} else if err != ErrDocNotExisted {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	checkAsBytes, err := json.Marshal(check)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(checkAsBytes)
+}
+
+// ============================================================
+// QueryNotarizationsByOwner - list the documents notarized for a user
+//
+// Inputs - Array of strings
+//  0
+//  ownerEmail
+//  "a@test.com"
+// ============================================================
+func (t *NotarizationMng) QueryNotarizationsByOwner(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting ownerEmail")
+	}
+	if len(args[0]) <= 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument must be a non-empty string")
+	}
+
+	queryResults, err := notarizationRepo.QueryByIndex(stub, IDX_OWNER_EMAIL_2_DOC_HASH, []string{args[0]})
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(queryResults)
+}
@@ -12,6 +12,23 @@ type PbResponse struct {
 	Error   string       `json:"error"`
 }
 
+// BatchResult is the Data of a batch function response
+type BatchResult struct {
+	Mode      string            `json:"mode"`
+	Total     int               `json:"total"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Items     []BatchItemResult `json:"items"`
+}
+
+// BatchItemResult is the result of one item of a batch
+type BatchItemResult struct {
+	Index int    `json:"index"`
+	Key   string `json:"key"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
 func SuccessPbResponse(data []byte) pb.Response {
 	var err error
 	response := PbResponse{RESP_CODE_SUCESS,"",""}
@@ -29,9 +46,14 @@ func SuccessPbResponse(data []byte) pb.Response {
 	return shim.Success(responseJSONasbytes)
 }
 
-func ErrorPbResponse(errCode string, errMsg string) pb.Response {
-	LogMessage("errCode[" + errCode + "] ErrorInfo:" + errMsg)
+func ErrorPbResponseWithData(errCode string, errMsg string, data []byte) pb.Response {
 	response := PbResponse{errCode, nil, errMsg }
+	if data != nil {
+		err := json.Unmarshal(data, &response.Data)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+		}
+	}
 	responseJSONasbytes, err := StructToJSONBytes(response)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -39,5 +61,25 @@ func ErrorPbResponse(errCode string, errMsg string) pb.Response {
 	return shim.Success(responseJSONasbytes)
 }
 
+func ErrorPbResponse(errCode string, errMsg string) pb.Response {
+	return ErrorPbResponseWithData(errCode, errMsg, nil)
+}
 
-
+// LogResponse logs the outcome of a transaction, errors by their code
+func LogResponse(stub shim.ChaincodeStubInterface, response pb.Response) {
+	if response.Status != shim.OK {
+		LogError(stub, "transaction failed", LogFields{"status": response.Status, "error": response.Message})
+		return
+	}
+	var pbResponse PbResponse
+	err := json.Unmarshal(response.Payload, &pbResponse)
+	if err != nil {
+		LogError(stub, "malformed response", LogFields{"error": err})
+	} else if pbResponse.Code == RESP_CODE_SYSTEM_ERROR {
+		LogError(stub, "transaction failed", LogFields{"code": pbResponse.Code, "error": pbResponse.Error})
+	} else if pbResponse.Code != RESP_CODE_SUCESS {
+		LogWarning(stub, "transaction rejected", LogFields{"code": pbResponse.Code, "error": pbResponse.Error})
+	} else {
+		LogDebug(stub, "transaction done")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"strconv"
+	"strings"
+)
+
+// Request signing authenticates the application user behind a transaction,
+// independently of the Fabric identity that submitted it. The client passes a
+// RequestAuth as JSON in the transient field TRANSIENT_REQUEST_AUTH and signs
+// RequestSigningMessage with the key of a signer registered on-ledger:
+//
+//	hmacSha256 - HMAC-SHA256, the secret travels in RequestAuth.Secret and must
+//	             match the SHA-256 registered for the signer
+//	ecdsaP256  - ECDSA P-256 over SHA-256, DER signature, verified with the
+//	             registered PEM public key
+//
+// Signers "user:" + userEmail are users that registered a public key on their
+// UserInfo (see RegisterUserPublicKey), they need no RegisterRequestSigner.
+//
+// Setting requestAuth decides what Invoke does with it: off ignores it, optional
+// verifies it when present, required rejects unsigned requests of non-admins
+// (admins authenticate through their MSP). Every accepted nonce is stored with the
+// signature until it expires (see nonce_registry.go), so a request can not be
+// replayed and the signature stays on the ledger.
+const (
+	REQUEST_AUTH_OFF      string = "off"
+	REQUEST_AUTH_OPTIONAL string = "optional"
+	REQUEST_AUTH_REQUIRED string = "required"
+
+	SIGN_ALG_HMAC_SHA256 string = "hmacSha256"
+	SIGN_ALG_ECDSA_P256  string = "ecdsaP256"
+
+	TRANSIENT_REQUEST_AUTH string = "requestAuth"
+	NS_REQUEST_SIGNER      string = NS_RESERVED + "signer_"
+	SIGNER_PREFIX_USER     string = "user:"
+)
+
+// RequestSigner is stored under NS_REQUEST_SIGNER + signerId
+type RequestSigner struct {
+	SignerId   string `json:"signerId"`
+	Algorithm  string `json:"algorithm"`
+	SecretHash string `json:"secretHash,omitempty"` // base64 SHA-256 of the HMAC secret
+	PublicKey  string `json:"publicKey,omitempty"`  // PEM
+	MspId      string `json:"mspId"`                // admin MSP that registered the signer
+	TxId       string `json:"txId"`
+}
+
+// RequestAuth is passed in the transient field TRANSIENT_REQUEST_AUTH
+type RequestAuth struct {
+	Signer    string `json:"signer"`
+	Nonce     string `json:"nonce"`
+	Timestamp int64  `json:"timestamp"` // unix seconds, within nonceTtl of the tx timestamp
+	Signature string `json:"signature"` // base64
+	Secret    string `json:"secret,omitempty"`
+}
+
+// RequestSigningMessage is what a client signs: the JSON array [signer, nonce, timestamp, function, args...]
+func RequestSigningMessage(signer string, nonce string, timestamp int64, function string, args []string) string {
+	message, _ := json.Marshal(append([]string{signer, nonce, strconv.FormatInt(timestamp, 10), function}, args...))
+	return string(message)
+}
+
+// GetRequestSigner returns nil if the signer is not registered
+func GetRequestSigner(stub shim.ChaincodeStubInterface, signerId string) (*RequestSigner, error) {
+	if strings.HasPrefix(signerId, SIGNER_PREFIX_USER) {
+		return getUserRequestSigner(stub, signerId)
+	}
+
+	valAsbytes, err := stub.GetState(NS_REQUEST_SIGNER + signerId)
+	if err != nil || valAsbytes == nil {
+		return nil, err
+	}
+	signer := &RequestSigner{}
+	err = json.Unmarshal(valAsbytes, signer)
+	return signer, err
+}
+
+// getUserRequestSigner returns nil if the user does not exist, is deleted or has no public key
+func getUserRequestSigner(stub shim.ChaincodeStubInterface, signerId string) (*RequestSigner, error) {
+	userInfo := UserInfo{}
+	err := userInfoRepo.Get(stub, strings.TrimPrefix(signerId, SIGNER_PREFIX_USER), &userInfo)
+	if err == ErrDocNotExisted {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if userInfo.UserStatus == ST_COMM_NILED || userInfo.UserPublicKey == "" {
+		return nil, nil
+	}
+	algorithm, err := PublicKeyAlgorithm(userInfo.UserPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &RequestSigner{SignerId: signerId, Algorithm: algorithm, PublicKey: userInfo.UserPublicKey}, nil
+}
+
+// PublicKeyAlgorithm is the signature algorithm of a PEM public key or certificate
+func PublicKeyAlgorithm(publicKeyPEM string) (string, error) {
+	if _, err := ParseECDSAP256PublicKey(publicKeyPEM); err == nil {
+		return SIGN_ALG_ECDSA_P256, nil
+	}
+	_, err := ParsePublicKeyPEM(publicKeyPEM)
+	if err == nil {
+		err = errors.New("public key must be ECDSA P-256")
+	}
+	return "", err
+}
+
+func PutRequestSigner(stub shim.ChaincodeStubInterface, signer *RequestSigner) error {
+	if strings.HasPrefix(signer.SignerId, SIGNER_PREFIX_USER) {
+		return errors.New("signerId must not start with " + SIGNER_PREFIX_USER + ", users register with RegisterUserPublicKey")
+	}
+
+	switch signer.Algorithm {
+	case SIGN_ALG_HMAC_SHA256:
+		hash, err := Base64Decoding(signer.SecretHash)
+		if err != nil || len(hash) != len(ComputeSHA256Bytes("")) {
+			return errors.New("secretHash must be a base64 SHA-256")
+		}
+	case SIGN_ALG_ECDSA_P256:
+		_, err := ParseECDSAP256PublicKey(signer.PublicKey)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("algorithm must be " + SIGN_ALG_HMAC_SHA256 + " or " + SIGN_ALG_ECDSA_P256)
+	}
+
+	signer.TxId = stub.GetTxID()
+	valAsbytes, err := json.Marshal(signer)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(NS_REQUEST_SIGNER+signer.SignerId, valAsbytes)
+}
+
+// getRequestAuth returns nil when the request is not signed
+func getRequestAuth(stub shim.ChaincodeStubInterface) (*RequestAuth, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	authAsBytes, ok := transient[TRANSIENT_REQUEST_AUTH]
+	if !ok {
+		return nil, nil
+	}
+	auth := &RequestAuth{}
+	err = json.Unmarshal(authAsBytes, auth)
+	if err != nil {
+		return nil, errors.New("Malformed " + TRANSIENT_REQUEST_AUTH + ": " + err.Error())
+	}
+	if auth.Signer == "" || auth.Nonce == "" || auth.Timestamp == 0 || auth.Signature == "" {
+		return nil, errors.New(TRANSIENT_REQUEST_AUTH + " needs signer, nonce, timestamp and signature")
+	}
+	return auth, nil
+}
+
+// AuthenticatedSigner returns the signer AuthenticateRequest verified for this
+// transaction, "" when the request is not signed or setting requestAuth is off
+func AuthenticatedSigner(stub shim.ChaincodeStubInterface) (string, error) {
+	mode, err := GetConfigString(stub, CFG_REQUEST_AUTH)
+	if err != nil || mode == REQUEST_AUTH_OFF {
+		return "", err
+	}
+	auth, err := getRequestAuth(stub)
+	if err != nil || auth == nil {
+		return "", err
+	}
+	return auth.Signer, nil
+}
+
+func verifyRequestSignature(signer *RequestSigner, auth *RequestAuth, message string) (bool, error) {
+	switch signer.Algorithm {
+	case SIGN_ALG_HMAC_SHA256:
+		secretHash, err := Base64Decoding(signer.SecretHash)
+		if err != nil {
+			return false, err
+		}
+		if !hmac.Equal(ComputeSHA256Bytes(auth.Secret), secretHash) {
+			return false, nil
+		}
+		return CheckMAC(message, auth.Signature, auth.Secret), nil
+	case SIGN_ALG_ECDSA_P256:
+		return VerifyECDSASignature(signer.PublicKey, message, auth.Signature)
+	}
+	return false, errors.New("unknown algorithm " + signer.Algorithm)
+}
+
+// =========================================================================================
+// AuthenticateRequest verifies the signature and nonce of a request before Invoke
+// dispatches it, ok is false when the request must be answered with response.
+// =========================================================================================
+func AuthenticateRequest(stub shim.ChaincodeStubInterface, function string, args []string) (pb.Response, bool) {
+	mode, err := GetConfigString(stub, CFG_REQUEST_AUTH)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error()), false
+	}
+	if mode == REQUEST_AUTH_OFF {
+		return pb.Response{}, true
+	}
+
+	auth, err := getRequestAuth(stub)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_UNAUTHENTICATED, err.Error()), false
+	}
+	if auth == nil {
+		if mode == REQUEST_AUTH_OPTIONAL {
+			return pb.Response{}, true
+		}
+		isAdmin, err := IsAdmin(stub)
+		if err != nil {
+			return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error()), false
+		} else if !isAdmin {
+			return ErrorPbResponse(RESP_CODE_UNAUTHENTICATED, "Request must be signed, see " + TRANSIENT_REQUEST_AUTH), false
+		}
+		return pb.Response{}, true
+	}
+
+	signer, err := GetRequestSigner(stub, auth.Signer)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error()), false
+	} else if signer == nil {
+		return ErrorPbResponse(RESP_CODE_UNAUTHENTICATED, "Unknown signer: " + auth.Signer), false
+	}
+	valid, err := verifyRequestSignature(signer, auth, RequestSigningMessage(auth.Signer, auth.Nonce, auth.Timestamp, function, args))
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error()), false
+	} else if !valid {
+		return ErrorPbResponse(RESP_CODE_UNAUTHENTICATED, "Invalid signature of signer " + auth.Signer), false
+	}
+
+	err = PutRequestNonce(stub, auth, function)
+	if err == errNonceUsed {
+		return ErrorPbResponse(RESP_CODE_NONCE_USED, "Nonce already used by signer " + auth.Signer), false
+	} else if err == errNonceExpired {
+		return ErrorPbResponse(RESP_CODE_UNAUTHENTICATED, "Request timestamp is too far from the transaction time"), false
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error()), false
+	}
+
+	LogInfo(stub, "request authenticated", LogFields{"signer": auth.Signer, "nonce": auth.Nonce})
+	return pb.Response{}, true
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Every doc written by a DocRepository carries the schema version of its docType in
+// SCHEMA_VERSION_FIELD, docs without it are version 1. A Migration upcasts a doc
+// from one version to the next; the code version of a docType is the highest To of
+// its migrations.
+//
+// Docs are upcast in memory whenever they are read, so a new version can be
+// deployed before the ledger is migrated. RunMigrationBatch then rewrites the docs
+// in bounded batches, keeping a cursor in the SchemaState of the docType so the
+// next transaction resumes where the previous one stopped.
+const (
+	SCHEMA_VERSION_FIELD string = "schemaVersion"
+	NS_SCHEMA_STATE      string = NS_RESERVED + "schema_"
+	MIGRATION_BATCH_SIZE int    = 200 // docs rewritten per transaction by default
+)
+
+type Migration struct {
+	DocType string
+	From    int
+	To      int
+	Upcast  func(doc map[string]interface{}) error
+}
+
+// SchemaState is stored under NS_SCHEMA_STATE + docType
+type SchemaState struct {
+	DocType  string `json:"docType"`
+	Version  int    `json:"version"`  // every doc on the ledger has at least this version
+	Target   int    `json:"target"`   // version of the running migration, equals Version when idle
+	Cursor   string `json:"cursor"`   // last key rewritten by the running migration
+	Migrated int    `json:"migrated"` // docs rewritten by the running migration
+	TxId     string `json:"txId"`     // last transaction that changed the state
+}
+
+var migrations = make(map[string][]Migration)
+
+// RegisterMigration is called from init() of the file holding the docType, migrations
+// of a docType must be registered in order: 1->2, 2->3...
+func RegisterMigration(migration Migration) {
+	if migration.To != migration.From+1 || migration.From != SchemaVersion(migration.DocType) || migration.Upcast == nil {
+		panic("invalid migration " + migration.DocType + " " + strconv.Itoa(migration.From) + "->" + strconv.Itoa(migration.To))
+	}
+	migrations[migration.DocType] = append(migrations[migration.DocType], migration)
+}
+
+// SchemaVersion is the version of a docType the code writes
+func SchemaVersion(docType string) int {
+	registered := migrations[docType]
+	if len(registered) == 0 {
+		return 1
+	}
+	return registered[len(registered)-1].To
+}
+
+func docSchemaVersion(fields map[string]interface{}) (int, error) {
+	value, ok := fields[SCHEMA_VERSION_FIELD]
+	if !ok || value == nil {
+		return 1, nil
+	}
+	version, err := strconv.Atoi(docFieldString(fields, SCHEMA_VERSION_FIELD))
+	if err != nil {
+		return 0, errors.New("Malformed " + SCHEMA_VERSION_FIELD + ": " + err.Error())
+	}
+	return version, nil
+}
+
+// UpcastDoc applies the migrations of a docType to a doc, returns whether it changed
+func UpcastDoc(docType string, fields map[string]interface{}) (bool, error) {
+	version, err := docSchemaVersion(fields)
+	if err != nil {
+		return false, err
+	}
+	target := SchemaVersion(docType)
+	if version > target {
+		return false, errors.New(docType + " doc has schema version " + strconv.Itoa(version) + ", newer than this chaincode " + strconv.Itoa(target))
+	}
+	if version == target {
+		return false, nil
+	}
+
+	for _, migration := range migrations[docType] {
+		if migration.From < version {
+			continue
+		}
+		err = migration.Upcast(fields)
+		if err != nil {
+			return false, errors.New("Failed to upcast " + docType + " to " + strconv.Itoa(migration.To) + ": " + err.Error())
+		}
+	}
+	fields[SCHEMA_VERSION_FIELD] = target
+	return true, nil
+}
+
+func GetSchemaState(stub shim.ChaincodeStubInterface, docType string) (*SchemaState, error) {
+	valAsbytes, err := stub.GetState(NS_SCHEMA_STATE + docType)
+	if err != nil {
+		return nil, err
+	}
+	if valAsbytes == nil {
+		// nothing recorded: the docType predates schema versions
+		return &SchemaState{DocType: docType, Version: 1, Target: 1}, nil
+	}
+	state := &SchemaState{}
+	err = json.Unmarshal(valAsbytes, state)
+	return state, err
+}
+
+func putSchemaState(stub shim.ChaincodeStubInterface, state *SchemaState) error {
+	state.TxId = stub.GetTxID()
+	valAsbytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(NS_SCHEMA_STATE+state.DocType, valAsbytes)
+}
+
+// =========================================================================================
+// RunMigrationBatch rewrites at most batchSize docs of a repository to the code version,
+// starting after the cursor of its SchemaState, and saves the new cursor. When the last
+// doc is reached the recorded version becomes the code version.
+// =========================================================================================
+func RunMigrationBatch(stub shim.ChaincodeStubInterface, repo *DocRepository, batchSize int) (*SchemaState, error) {
+	state, err := GetSchemaState(stub, repo.DocType)
+	if err != nil {
+		return nil, err
+	}
+
+	target := SchemaVersion(repo.DocType)
+	if state.Version > target {
+		return nil, errors.New(repo.DocType + " ledger schema version " + strconv.Itoa(state.Version) + " is newer than this chaincode " + strconv.Itoa(target))
+	}
+	if state.Version == target {
+		return state, nil
+	}
+	if state.Target != target {
+		// start a new migration, or restart one left by an older chaincode version
+		state.Target = target
+		state.Cursor = ""
+		state.Migrated = 0
+	}
+
+	startKey := repo.Namespace()
+	if state.Cursor != "" {
+		// the smallest key after the cursor
+		startKey = state.Cursor + "\x00"
+	}
+	resultsIterator, err := stub.GetStateByRange(startKey, repo.Namespace()+string(utf8.MaxRune))
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	count := 0
+	for count < batchSize && resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		err = repo.migrate(stub, queryResponse.Key, queryResponse.Value)
+		if err != nil {
+			return nil, err
+		}
+		state.Cursor = queryResponse.Key
+		count++
+	}
+	state.Migrated += count
+
+	if !resultsIterator.HasNext() {
+		LogInfo(stub, "migration done", LogFields{"docType": repo.DocType, "version": target, "migrated": state.Migrated})
+		state.Version = target
+		state.Cursor = ""
+	}
+
+	err = putSchemaState(stub, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// RunPendingMigrations runs one batch for every repository whose ledger version is behind
+func RunPendingMigrations(stub shim.ChaincodeStubInterface, batchSize int) ([]*SchemaState, error) {
+	docTypes := make([]string, 0, len(docRepositories))
+	for docType := range docRepositories {
+		docTypes = append(docTypes, docType)
+	}
+	sort.Strings(docTypes)
+
+	var states []*SchemaState
+	for _, docType := range docTypes {
+		if SchemaVersion(docType) == 1 {
+			continue
+		}
+		state, err := RunMigrationBatch(stub, docRepositories[docType], batchSize)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
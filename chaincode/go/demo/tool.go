@@ -1,8 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"math/rand"
 	"time"
 )
@@ -27,16 +28,22 @@ func GenerateRandom(size int) string {
 func StructToJSONBytes(data interface{}) ([]byte, error) {
 	b, err := json.Marshal(data)
 	if err != nil {
-		fmt.Println(err)
+		LogError(nil, "StructToJSONBytes failed", LogFields{"error": err})
 		return nil, err
 	}
 	return b, nil
 }
 
-func LogMessage(message string) {
-	fmt.Println(message)
-}
-
-func LogStruct(data interface{}) {
-	fmt.Printf("%+v\n", data)
+//CompactJSONObject 校验并压缩JSON对象, 空字符串返回nil
+func CompactJSONObject(jsonStr string) (json.RawMessage, error) {
+	if len(jsonStr) == 0 {
+		return nil, nil
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal([]byte(jsonStr), &fields) != nil || fields == nil {
+		return nil, errors.New("must be a JSON object")
+	}
+	var compacted bytes.Buffer
+	err := json.Compact(&compacted, []byte(jsonStr))
+	return compacted.Bytes(), err
 }
@@ -0,0 +1,669 @@
+// entitygen generates the manager of a new entity of the demo chaincode, following
+// the UserMng pattern: DT_/NS_/PK_FD_/IDX_ constants, a DocRepository, the
+// Init/Read/Change/Delete/Query/History handlers, their router registration and
+// MockStub tests.
+//
+// Annotate the struct with entity tags and add a go:generate line next to it:
+//
+//	//go:generate go run ../entitygen/main.go -type OrgInfo
+//	type OrgInfo struct {
+//		DocType   string `json:"docType"`
+//		OrgCode   string `json:"orgCode" entity:"pk"`
+//		OrgName   string `json:"orgName" entity:"mutable"`
+//		OrgType   string `json:"orgType" entity:"index"`
+//		OrgStatus string `json:"orgStatus" entity:"status,index"`
+//	}
+//
+//	pk       the primary key, exactly one field
+//	index    a secondary index {field}_2_{pk} and a QueryXxxBy{Field} function
+//	mutable  the field can be changed by ChangeXxx
+//	status   set to ST_COMM_INIT on init and ST_COMM_NILED on delete (soft delete),
+//	         without a status field DeleteXxx removes the doc
+//
+// Every field but docType must be a string. The output is {type}_mng_gen.go and
+// {type}_mng_gen_test.go next to the input file, {type} in snake case, e.g.
+// org_info_mng_gen.go, so every type of a file gets its own manager.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+type entityField struct {
+	Name    string // Go field name
+	JSON    string // json field name
+	Const   string // upper snake case of JSON
+	PK      bool
+	Index   bool
+	Mutable bool
+	Status  bool
+}
+
+type entity struct {
+	Package string
+	Source  string
+	Type    string // OrgInfo
+	Const   string // ORG_INFO
+	DocType string // orgInfo
+	Var     string // orgInfo, used for variables
+	Fields  []entityField
+	PK      entityField
+	Status  *entityField
+}
+
+func main() {
+	typeName := flag.String("type", "", "name of the entity struct")
+	fileName := flag.String("file", os.Getenv("GOFILE"), "go file holding the entity struct, defaults to $GOFILE")
+	flag.Parse()
+
+	if *typeName == "" || *fileName == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(*fileName, *typeName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "entitygen: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(fileName string, typeName string) error {
+	e, err := parseEntity(fileName, typeName)
+	if err != nil {
+		return err
+	}
+
+	base := filepath.Join(filepath.Dir(fileName), strings.ToLower(e.Const))
+	code, err := generate(mngTemplate, e)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(base+"_mng_gen.go", code, 0644)
+	if err != nil {
+		return err
+	}
+
+	code, err = generate(mngTestTemplate, e)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(base+"_mng_gen_test.go", code, 0644)
+}
+
+func parseEntity(fileName string, typeName string) (*entity, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, fileName, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var structType *ast.StructType
+	ast.Inspect(file, func(node ast.Node) bool {
+		if spec, ok := node.(*ast.TypeSpec); ok && spec.Name.Name == typeName {
+			structType, _ = spec.Type.(*ast.StructType)
+		}
+		return structType == nil
+	})
+	if structType == nil {
+		return nil, errors.New("struct " + typeName + " not found in " + fileName)
+	}
+
+	e := &entity{
+		Package: file.Name.Name,
+		Source:  filepath.Base(fileName),
+		Type:    typeName,
+		Const:   upperSnake(typeName),
+		DocType: lowerFirst(typeName),
+		Var:     lowerFirst(typeName),
+	}
+
+	pkCount := 0
+	hasDocType := false
+	for _, field := range structType.Fields.List {
+		if len(field.Names) != 1 || field.Tag == nil {
+			return nil, errors.New(typeName + ": every field needs its own name and a json tag")
+		}
+		tag, err := strconv.Unquote(field.Tag.Value)
+		if err != nil {
+			return nil, err
+		}
+		jsonName := strings.Split(reflect.StructTag(tag).Get("json"), ",")[0]
+		if jsonName == "" || jsonName == "-" {
+			return nil, errors.New(typeName + "." + field.Names[0].Name + ": missing json tag")
+		}
+		if ident, ok := field.Type.(*ast.Ident); !ok || ident.Name != "string" {
+			return nil, errors.New(typeName + "." + field.Names[0].Name + ": only string fields are supported")
+		}
+		if jsonName == "docType" {
+			hasDocType = true
+			continue
+		}
+
+		f := entityField{Name: field.Names[0].Name, JSON: jsonName, Const: upperSnake(jsonName)}
+		for _, option := range strings.Split(reflect.StructTag(tag).Get("entity"), ",") {
+			switch strings.TrimSpace(option) {
+			case "":
+			case "pk":
+				f.PK = true
+			case "index":
+				f.Index = true
+			case "mutable":
+				f.Mutable = true
+			case "status":
+				f.Status = true
+			default:
+				return nil, errors.New(typeName + "." + f.Name + ": unknown entity option " + option)
+			}
+		}
+		if f.PK && (f.Mutable || f.Status || f.Index) {
+			return nil, errors.New(typeName + "." + f.Name + ": the pk can not be mutable, status or index")
+		}
+		if f.Status && f.Mutable {
+			return nil, errors.New(typeName + "." + f.Name + ": the status can not be mutable")
+		}
+		if f.PK {
+			pkCount++
+			e.PK = f
+		}
+		if f.Status {
+			if e.Status != nil {
+				return nil, errors.New(typeName + ": only one status field is allowed")
+			}
+			status := f
+			e.Status = &status
+		}
+		e.Fields = append(e.Fields, f)
+	}
+
+	if !hasDocType {
+		return nil, errors.New(typeName + ": a DocType field with json tag docType is required")
+	}
+	if pkCount != 1 {
+		return nil, errors.New(typeName + ": exactly one field must be tagged entity:\"pk\"")
+	}
+	return e, nil
+}
+
+func generate(tmpl *template.Template, e *entity) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := tmpl.Execute(&buffer, e)
+	if err != nil {
+		return nil, err
+	}
+	code, err := format.Source(buffer.Bytes())
+	if err != nil {
+		return nil, errors.New("generated code does not compile: " + err.Error() + "\n" + buffer.String())
+	}
+	return code, nil
+}
+
+// InitArgs are the fields passed to InitXxx: every field but the status
+func (e *entity) InitArgs() []entityField {
+	var fields []entityField
+	for _, f := range e.Fields {
+		if !f.Status {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func (e *entity) MutableFields() []entityField {
+	var fields []entityField
+	for _, f := range e.Fields {
+		if f.Mutable {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func (e *entity) IndexFields() []entityField {
+	var fields []entityField
+	for _, f := range e.Fields {
+		if f.Index {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func upperSnake(name string) string {
+	var buffer bytes.Buffer
+	runes := []rune(name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			buffer.WriteRune('_')
+		}
+		buffer.WriteRune(unicode.ToUpper(r))
+	}
+	return buffer.String()
+}
+
+func lowerFirst(name string) string {
+	runes := []rune(name)
+	runes[0] = unicode.ToLower(runes[0])
+	return string(runes)
+}
+
+func ordinal(i int) string {
+	n := i + 1
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+		return strconv.Itoa(n) + "th"
+	case n%10 == 1:
+		return strconv.Itoa(n) + "st"
+	case n%10 == 2:
+		return strconv.Itoa(n) + "nd"
+	case n%10 == 3:
+		return strconv.Itoa(n) + "rd"
+	}
+	return strconv.Itoa(n) + "th"
+}
+
+func quoteNames(fields []entityField) string {
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = strconv.Quote(f.JSON)
+	}
+	return strings.Join(names, ", ")
+}
+
+var funcs = template.FuncMap{
+	"ordinal":    ordinal,
+	"quoteNames": quoteNames,
+	"add":        func(a int, b int) int { return a + b },
+}
+
+var mngTemplate = template.Must(template.New("mng").Funcs(funcs).Parse(`// Code generated by entitygen from {{.Source}}; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	DT_{{.Const}} string = "{{.DocType}}"
+	NS_{{.Const}} string = DT_{{.Const}} + "_"
+	PK_FD_{{.Const}} string = "{{.PK.JSON}}"
+{{- range .IndexFields}}
+	IDX_FD_{{.Const}} string = "{{.JSON}}"
+	IDX_{{.Const}}_2_{{$.PK.Const}} string = IDX_FD_{{.Const}} + "_2_" + PK_FD_{{$.Const}}
+{{- end}}
+)
+
+type {{.Type}}Mng struct{}
+
+// {{.Var}}Repo stores {{.Type}} under NS_{{.Const}}
+var {{.Var}}Repo = NewDocRepository(DT_{{.Const}}, PK_FD_{{.Const}},
+{{- range .IndexFields}}
+	DocIndex{IDX_{{.Const}}_2_{{$.PK.Const}}, []string{IDX_FD_{{.Const}}}},
+{{- end}}
+)
+
+func init() {
+	RegisterRouter(new({{.Type}}Mng))
+}
+
+// Route dispatches the {{.Type}} functions for DomoChaincode.Invoke
+func (t *{{.Type}}Mng) Route(stub shim.ChaincodeStubInterface, function string, args []string) (pb.Response, bool) {
+	switch function {
+	case "Init{{.Type}}":
+		return t.Init{{.Type}}(stub, args), true
+	case "Read{{.Type}}":
+		return t.Read{{.Type}}(stub, args), true
+{{- if .MutableFields}}
+	case "Change{{.Type}}":
+		return t.Change{{.Type}}(stub, args), true
+{{- end}}
+	case "Delete{{.Type}}":
+		return t.Delete{{.Type}}(stub, args), true
+{{- range .IndexFields}}
+	case "Query{{$.Type}}By{{.Name}}":
+		return t.Query{{$.Type}}By{{.Name}}(stub, args), true
+{{- end}}
+	case "GetHistoryFor{{.Type}}":
+		return t.GetHistoryFor{{.Type}}(stub, args), true
+	}
+	return pb.Response{}, false
+}
+
+// ============================================================
+// Init{{.Type}} - create a new {{.DocType}}, store into chaincode state
+// ============================================================
+func (t *{{.Type}}Mng) Init{{.Type}}(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	// {{quoteNames .InitArgs}}
+	if len(args) != {{len .InitArgs}} {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting {{len .InitArgs}}")
+	}
+
+	// ==== Input sanitation ====
+{{- range $i, $f := .InitArgs}}
+	if len(args[{{$i}}]) <= 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "{{ordinal $i}} argument must be a non-empty string")
+	}
+{{- end}}
+
+	{{.Var}} := {{.Type}}{DocType: DT_{{.Const}}}
+{{- range $i, $f := .InitArgs}}
+	{{$.Var}}.{{$f.Name}} = args[{{$i}}]
+{{- end}}
+{{- if .Status}}
+	{{.Var}}.{{.Status.Name}} = ST_COMM_INIT
+{{- end}}
+
+	err := {{.Var}}Repo.Insert(stub, &{{.Var}})
+	if err == ErrDocAlreadyExists {
+		return ErrorPbResponse(RESP_CODE_DATA_ALREADY_EXIST, "This {{.Type}} already exists: "+{{.Var}}.{{.PK.Name}})
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	LogInfo(stub, "end Init{{.Type}}", LogFields{"{{.PK.JSON}}": {{.Var}}.{{.PK.Name}}})
+	return SuccessPbResponse(nil)
+}
+
+// ============================================================
+// Read{{.Type}} - read a {{.DocType}} from chaincode state
+// ============================================================
+func (t *{{.Type}}Mng) Read{{.Type}}(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting {{.PK.JSON}}")
+	}
+
+	valAsbytes, err := {{.Var}}Repo.GetBytes(stub, args[0])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	} else if valAsbytes == nil {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "{{.Type}} does not exist: "+args[0])
+	}
+
+	return SuccessPbResponse(valAsbytes)
+}
+{{- if .MutableFields}}
+
+// ============================================================
+// Change{{.Type}} - change the mutable fields of a {{.DocType}}
+// ============================================================
+func (t *{{.Type}}Mng) Change{{.Type}}(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	// "{{.PK.JSON}}", {{quoteNames .MutableFields}}
+	if len(args) != {{add 1 (len .MutableFields)}} {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting {{add 1 (len .MutableFields)}}")
+	}
+
+	// ==== Input sanitation ====
+	if len(args[0]) <= 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument must be a non-empty string")
+	}
+{{- range $i, $f := .MutableFields}}
+	if len(args[{{add $i 1}}]) <= 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "{{ordinal (add $i 1)}} argument must be a non-empty string")
+	}
+{{- end}}
+
+	{{.Var}}ToUpdate := {{.Type}}{}
+	err := {{.Var}}Repo.Get(stub, args[0], &{{.Var}}ToUpdate)
+	if err == ErrDocNotExisted {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "{{.Type}} does not exist: "+args[0])
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	isChanged := false
+{{- range $i, $f := .MutableFields}}
+	if {{$.Var}}ToUpdate.{{$f.Name}} != args[{{add $i 1}}] {
+		{{$.Var}}ToUpdate.{{$f.Name}} = args[{{add $i 1}}]
+		isChanged = true
+	}
+{{- end}}
+
+	if !isChanged {
+		LogInfo(stub, "end Change{{.Type}} (no change no commit)", LogFields{"{{.PK.JSON}}": args[0]})
+		return SuccessPbResponse(nil)
+	}
+
+	err = {{.Var}}Repo.Update(stub, &{{.Var}}ToUpdate)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	LogInfo(stub, "end Change{{.Type}} (success)", LogFields{"{{.PK.JSON}}": args[0]})
+	return SuccessPbResponse(nil)
+}
+{{- end}}
+
+// ============================================================
+// Delete{{.Type}} - {{if .Status}}set a {{.DocType}} to ST_COMM_NILED{{else}}remove a {{.DocType}} and its index keys{{end}}
+// ============================================================
+func (t *{{.Type}}Mng) Delete{{.Type}}(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting 1")
+	}
+	if len(args[0]) <= 0 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "1st argument must be a non-empty string")
+	}
+{{- if .Status}}
+
+	{{.Var}}ToUpdate := {{.Type}}{}
+	err := {{.Var}}Repo.Get(stub, args[0], &{{.Var}}ToUpdate)
+	if err == ErrDocNotExisted {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "{{.Type}} does not exist: "+args[0])
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+
+	if {{.Var}}ToUpdate.{{.Status.Name}} == ST_COMM_NILED {
+		LogInfo(stub, "end Delete{{.Type}} (success), {{.Type}} was already deleted", LogFields{"{{.PK.JSON}}": args[0]})
+		return SuccessPbResponse(nil)
+	}
+
+	{{.Var}}ToUpdate.{{.Status.Name}} = ST_COMM_NILED
+	err = {{.Var}}Repo.Update(stub, &{{.Var}}ToUpdate)
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+{{- else}}
+
+	err := {{.Var}}Repo.Delete(stub, args[0])
+	if err == ErrDocNotExisted {
+		return ErrorPbResponse(RESP_CODE_DATA_NOT_EXISTED, "{{.Type}} does not exist: "+args[0])
+	} else if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+{{- end}}
+
+	LogInfo(stub, "end Delete{{.Type}} (success)", LogFields{"{{.PK.JSON}}": args[0]})
+	return SuccessPbResponse(nil)
+}
+{{- range .IndexFields}}
+
+// ============================================================
+// Query{{$.Type}}By{{.Name}} - read the {{$.DocType}}s with a {{.JSON}} from IDX_{{.Const}}_2_{{$.PK.Const}}
+// ============================================================
+func (t *{{$.Type}}Mng) Query{{$.Type}}By{{.Name}}(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting {{.JSON}}")
+	}
+
+	queryResults, err := {{$.Var}}Repo.QueryByIndex(stub, IDX_{{.Const}}_2_{{$.PK.Const}}, []string{args[0]})
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(queryResults)
+}
+{{- end}}
+
+// ============================================================
+// GetHistoryFor{{.Type}} - read every committed version of a {{.DocType}}
+// ============================================================
+func (t *{{.Type}}Mng) GetHistoryFor{{.Type}}(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return ErrorPbResponse(RESP_CODE_ARGUMENTS_ERROR, "Incorrect number of arguments. Expecting {{.PK.JSON}}")
+	}
+
+	historyAsBytes, err := {{.Var}}Repo.History(stub, args[0])
+	if err != nil {
+		return ErrorPbResponse(RESP_CODE_SYSTEM_ERROR, err.Error())
+	}
+	return SuccessPbResponse(historyAsBytes)
+}
+`))
+
+var mngTestTemplate = template.Must(template.New("mngTest").Funcs(funcs).Parse(`// Code generated by entitygen from {{.Source}}; DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func invoke{{.Type}}Mng(t *testing.T, stub *shim.MockStub, args ...string) PbResponse {
+	argsAsBytes := make([][]byte, len(args))
+	for i, arg := range args {
+		argsAsBytes[i] = []byte(arg)
+	}
+	res := stub.MockInvoke("1", argsAsBytes)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.FailNow()
+	}
+	response := PbResponse{}
+	err := json.Unmarshal(res.Payload, &response)
+	if err != nil {
+		fmt.Println("Invoke", args, "returned", string(res.Payload))
+		t.FailNow()
+	}
+	return response
+}
+
+func check{{.Type}}MngCode(t *testing.T, response PbResponse, code string) {
+	if response.Code != code {
+		fmt.Println("Response code was", response.Code, "not", code, "as expected:", response.Error)
+		t.FailNow()
+	}
+}
+
+func read{{.Type}}(t *testing.T, stub *shim.MockStub, id string) {{.Type}} {
+	response := invoke{{.Type}}Mng(t, stub, "Read{{.Type}}", id)
+	check{{.Type}}MngCode(t, response, RESP_CODE_SUCESS)
+	dataAsBytes, _ := json.Marshal(response.Data)
+	{{.Var}} := {{.Type}}{}
+	json.Unmarshal(dataAsBytes, &{{.Var}})
+	return {{.Var}}
+}
+
+func init{{.Type}}(t *testing.T, stub *shim.MockStub, n int) {
+	response := invoke{{.Type}}Mng(t, stub, "Init{{.Type}}"{{range .InitArgs}}, fmt.Sprintf("{{.JSON}}_%d", n){{end}})
+	check{{.Type}}MngCode(t, response, RESP_CODE_SUCESS)
+}
+
+func Test{{.Type}}Mng_Init(t *testing.T) {
+	stub := shim.NewMockStub("{{.DocType}}", new(DomoChaincode))
+
+	init{{.Type}}(t, stub, 1)
+	response := invoke{{.Type}}Mng(t, stub, "Init{{.Type}}"{{range .InitArgs}}, "{{.JSON}}_1"{{end}})
+	check{{.Type}}MngCode(t, response, RESP_CODE_DATA_ALREADY_EXIST)
+
+	response = invoke{{.Type}}Mng(t, stub, "Init{{.Type}}", "{{.PK.JSON}}_2")
+	check{{.Type}}MngCode(t, response, RESP_CODE_ARGUMENTS_ERROR)
+}
+
+func Test{{.Type}}Mng_Read(t *testing.T) {
+	stub := shim.NewMockStub("{{.DocType}}", new(DomoChaincode))
+
+	init{{.Type}}(t, stub, 1)
+	{{.Var}} := read{{.Type}}(t, stub, "{{.PK.JSON}}_1")
+	if {{.Var}}.DocType != DT_{{.Const}}{{range .InitArgs}} || {{$.Var}}.{{.Name}} != "{{.JSON}}_1"{{end}}{{if .Status}} || {{.Var}}.{{.Status.Name}} != ST_COMM_INIT{{end}} {
+		fmt.Println("Read{{.Type}} returned", {{.Var}})
+		t.FailNow()
+	}
+
+	response := invoke{{.Type}}Mng(t, stub, "Read{{.Type}}", "{{.PK.JSON}}_2")
+	check{{.Type}}MngCode(t, response, RESP_CODE_DATA_NOT_EXISTED)
+}
+{{- if .MutableFields}}
+
+func Test{{.Type}}Mng_Change(t *testing.T) {
+	stub := shim.NewMockStub("{{.DocType}}", new(DomoChaincode))
+
+	init{{.Type}}(t, stub, 1)
+	response := invoke{{.Type}}Mng(t, stub, "Change{{.Type}}", "{{.PK.JSON}}_1"{{range .MutableFields}}, "{{.JSON}}_changed"{{end}})
+	check{{.Type}}MngCode(t, response, RESP_CODE_SUCESS)
+
+	{{.Var}} := read{{.Type}}(t, stub, "{{.PK.JSON}}_1")
+	if {{range $i, $f := .MutableFields}}{{if $i}} || {{end}}{{$.Var}}.{{$f.Name}} != "{{$f.JSON}}_changed"{{end}} {
+		fmt.Println("Change{{.Type}} was not applied", {{.Var}})
+		t.FailNow()
+	}
+
+	response = invoke{{.Type}}Mng(t, stub, "Change{{.Type}}", "{{.PK.JSON}}_2"{{range .MutableFields}}, "{{.JSON}}_changed"{{end}})
+	check{{.Type}}MngCode(t, response, RESP_CODE_DATA_NOT_EXISTED)
+}
+{{- end}}
+
+func Test{{.Type}}Mng_Delete(t *testing.T) {
+	stub := shim.NewMockStub("{{.DocType}}", new(DomoChaincode))
+
+	init{{.Type}}(t, stub, 1)
+	response := invoke{{.Type}}Mng(t, stub, "Delete{{.Type}}", "{{.PK.JSON}}_1")
+	check{{.Type}}MngCode(t, response, RESP_CODE_SUCESS)
+{{- if .Status}}
+
+	{{.Var}} := read{{.Type}}(t, stub, "{{.PK.JSON}}_1")
+	if {{.Var}}.{{.Status.Name}} != ST_COMM_NILED {
+		fmt.Println("Delete{{.Type}} did not nil", {{.Var}})
+		t.FailNow()
+	}
+{{- else}}
+
+	response = invoke{{.Type}}Mng(t, stub, "Read{{.Type}}", "{{.PK.JSON}}_1")
+	check{{.Type}}MngCode(t, response, RESP_CODE_DATA_NOT_EXISTED)
+{{- end}}
+
+	response = invoke{{.Type}}Mng(t, stub, "Delete{{.Type}}", "{{.PK.JSON}}_2")
+	check{{.Type}}MngCode(t, response, RESP_CODE_DATA_NOT_EXISTED)
+}
+{{- range .IndexFields}}
+
+func Test{{$.Type}}Mng_QueryBy{{.Name}}(t *testing.T) {
+	stub := shim.NewMockStub("{{$.DocType}}", new(DomoChaincode))
+
+	init{{$.Type}}(t, stub, 1)
+	init{{$.Type}}(t, stub, 2)
+{{- if .Status}}
+	response := invoke{{$.Type}}Mng(t, stub, "Query{{$.Type}}By{{.Name}}", ST_COMM_INIT)
+	expected := 2
+{{- else}}
+	response := invoke{{$.Type}}Mng(t, stub, "Query{{$.Type}}By{{.Name}}", "{{.JSON}}_1")
+	expected := 1
+{{- end}}
+	check{{$.Type}}MngCode(t, response, RESP_CODE_SUCESS)
+	if docs, ok := response.Data.([]interface{}); !ok || len(docs) != expected {
+		fmt.Println("Query{{$.Type}}By{{.Name}} returned", response.Data)
+		t.FailNow()
+	}
+}
+{{- end}}
+`))
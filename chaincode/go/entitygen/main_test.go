@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func checkGenerated(t *testing.T, typeName string, file string, expected []string, unexpected []string) {
+	dir, err := ioutil.TempDir("", "entitygen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source, err := ioutil.ReadFile(filepath.Join("testdata", "org_info.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "org_info.go"), source, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = run(filepath.Join(dir, "org_info.go"), typeName)
+	if err != nil {
+		fmt.Println("entitygen failed", err)
+		t.FailNow()
+	}
+
+	codeAsBytes, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gofmt aligns the const block, compare with single spaces
+	code := strings.Join(strings.Fields(string(codeAsBytes)), " ")
+	for _, s := range expected {
+		if !strings.Contains(code, s) {
+			fmt.Println(file, "does not contain", s)
+			t.FailNow()
+		}
+	}
+	for _, s := range unexpected {
+		if strings.Contains(code, s) {
+			fmt.Println(file, "should not contain", s)
+			t.FailNow()
+		}
+	}
+}
+
+func TestEntitygen_Mng(t *testing.T) {
+	checkGenerated(t, "OrgInfo", "org_info_mng_gen.go", []string{
+		`DT_ORG_INFO string = "orgInfo"`,
+		`PK_FD_ORG_INFO string = "orgCode"`,
+		`IDX_ORG_TYPE_2_ORG_CODE string = IDX_FD_ORG_TYPE + "_2_" + PK_FD_ORG_INFO`,
+		`IDX_ORG_STATUS_2_ORG_CODE string = IDX_FD_ORG_STATUS + "_2_" + PK_FD_ORG_INFO`,
+		`RegisterRouter(new(OrgInfoMng))`,
+		`func (t *OrgInfoMng) InitOrgInfo(`,
+		`if len(args) != 3 {`,
+		`orgInfo.OrgStatus = ST_COMM_INIT`,
+		`func (t *OrgInfoMng) ChangeOrgInfo(`,
+		`orgInfoToUpdate.OrgStatus = ST_COMM_NILED`,
+		`func (t *OrgInfoMng) QueryOrgInfoByOrgType(`,
+		`func (t *OrgInfoMng) QueryOrgInfoByOrgStatus(`,
+		`func (t *OrgInfoMng) GetHistoryForOrgInfo(`,
+	}, nil)
+}
+
+func TestEntitygen_MngWithoutStatus(t *testing.T) {
+	checkGenerated(t, "OrgTag", "org_tag_mng_gen.go", []string{
+		`PK_FD_ORG_TAG string = "tagID"`,
+		`err := orgTagRepo.Delete(stub, args[0])`,
+	}, []string{
+		`ChangeOrgTag`,
+		`QueryOrgTagBy`,
+		`ST_COMM_NILED`,
+	})
+}
+
+func TestEntitygen_TypesOfOneFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "entitygen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source, err := ioutil.ReadFile(filepath.Join("testdata", "org_info.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "org_info.go"), source, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typeName := range []string{"OrgInfo", "OrgTag"} {
+		err = run(filepath.Join(dir, "org_info.go"), typeName)
+		if err != nil {
+			fmt.Println("entitygen failed", err)
+			t.FailNow()
+		}
+	}
+	for _, file := range []string{"org_info_mng_gen.go", "org_info_mng_gen_test.go", "org_tag_mng_gen.go", "org_tag_mng_gen_test.go"} {
+		codeAsBytes, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		typeName := "OrgInfo"
+		if strings.HasPrefix(file, "org_tag") {
+			typeName = "OrgTag"
+		}
+		if !strings.Contains(string(codeAsBytes), typeName+"Mng") {
+			fmt.Println(file, "is not the manager of", typeName)
+			t.FailNow()
+		}
+	}
+}
+
+func TestEntitygen_MngTest(t *testing.T) {
+	checkGenerated(t, "OrgInfo", "org_info_mng_gen_test.go", []string{
+		`func TestOrgInfoMng_Init(t *testing.T) {`,
+		`func TestOrgInfoMng_Change(t *testing.T) {`,
+		`func TestOrgInfoMng_Delete(t *testing.T) {`,
+		`func TestOrgInfoMng_QueryByOrgType(t *testing.T) {`,
+		`func TestOrgInfoMng_QueryByOrgStatus(t *testing.T) {`,
+	}, nil)
+}
+
+func TestEntitygen_Names(t *testing.T) {
+	cases := map[string]string{"OrgInfo": "ORG_INFO", "userEmail": "USER_EMAIL", "tagID": "TAG_ID", "HTTPServer": "HTTP_SERVER"}
+	for name, expected := range cases {
+		if upperSnake(name) != expected {
+			fmt.Println("upperSnake", name, "was", upperSnake(name), "not", expected)
+			t.FailNow()
+		}
+	}
+	if ordinal(0) != "1st" || ordinal(1) != "2nd" || ordinal(2) != "3rd" || ordinal(3) != "4th" || ordinal(10) != "11th" {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+//go:generate go run ../entitygen/main.go -type OrgInfo
+type OrgInfo struct {
+	DocType   string `json:"docType"`
+	OrgCode   string `json:"orgCode" entity:"pk"`
+	OrgName   string `json:"orgName" entity:"mutable"`
+	OrgType   string `json:"orgType" entity:"index,mutable"`
+	OrgStatus string `json:"orgStatus" entity:"status,index"`
+}
+
+type OrgTag struct {
+	DocType string `json:"docType"`
+	TagID   string `json:"tagID" entity:"pk"`
+	TagName string `json:"tagName"`
+}
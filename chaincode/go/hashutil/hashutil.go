@@ -0,0 +1,35 @@
+// Package hashutil holds the SHA-256 helpers shared by the demo and example02
+// chaincodes, so that digests compare across them. Chaincodes import it as
+// github.com/hyperledger/fabric/examples/chaincode/go/hashutil; peer chaincode
+// install packages it from the GOPATH with the chaincode.
+package hashutil
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+)
+
+// SHA256 returns the SHA-256 of message
+func SHA256(message string) []byte {
+	h := sha256.Sum256([]byte(message))
+	return h[:]
+}
+
+// SHA256Hex returns the SHA-256 of message as lower case hex
+func SHA256Hex(message string) string {
+	return hex.EncodeToString(SHA256(message))
+}
+
+// NormalizeSHA256 accepts a SHA-256 as hex or base64 and returns it as lower case hex
+func NormalizeSHA256(digest string) (string, error) {
+	digestBytes, err := hex.DecodeString(digest)
+	if err != nil || len(digestBytes) != sha256.Size {
+		digestBytes, err = base64.StdEncoding.DecodeString(digest)
+	}
+	if err != nil || len(digestBytes) != sha256.Size {
+		return "", errors.New("expecting a SHA-256 as 64 hex characters or base64")
+	}
+	return hex.EncodeToString(digestBytes), nil
+}
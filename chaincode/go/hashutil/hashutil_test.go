@@ -0,0 +1,29 @@
+package hashutil
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// the SHA-256 of "abc", FIPS 180-2 appendix B.1
+const abcHex = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+
+func TestSHA256Hex(t *testing.T) {
+	if SHA256Hex("abc") != abcHex {
+		t.Fatal("SHA256Hex was", SHA256Hex("abc"))
+	}
+}
+
+func TestNormalizeSHA256(t *testing.T) {
+	for _, digest := range []string{abcHex, "BA7816BF8F01CFEA414140DE5DAE2223B00361A396177A9CB410FF61F20015AD", base64.StdEncoding.EncodeToString(SHA256("abc"))} {
+		normalized, err := NormalizeSHA256(digest)
+		if err != nil || normalized != abcHex {
+			t.Fatal("NormalizeSHA256", digest, "was", normalized, err)
+		}
+	}
+	for _, digest := range []string{"", "abc", abcHex[:62], base64.StdEncoding.EncodeToString([]byte("abc"))} {
+		if _, err := NormalizeSHA256(digest); err == nil {
+			t.Fatal("NormalizeSHA256 accepted", digest)
+		}
+	}
+}
@@ -162,7 +162,7 @@ chaincodeQuery () {
      sleep 3
      echo "Attempting to Query PEER$PEER ...$(($(date +%s)-starttime)) secs"
      peer chaincode query -C $CHANNEL_NAME -n $CHAINCODE_ID -c $CCQUERY_ARGS >&log.txt
-     test $? -eq 0 && VALUE=$(cat log.txt | awk '/Query Result/ {print $NF}')
+     test $? -eq 0 && VALUE=$(cat log.txt | awk '/Query Result/ {print $NF}' | sed 's/.*"amount":"\([^"]*\)".*/\1/')
      test "$VALUE" = "$EXPECTED_RSLT" && let rc=0
   done
   echo
@@ -253,9 +253,9 @@ instantiateChaincode 2 '{"Args":["init","a","100","b","200"]}' mycc 1.0
 echo "Querying chaincode on org1/peer0..."
 chaincodeQuery 0 '{"Args":["query","a"]}' mycc 100
 
-#Invoke on chaincode on Peer0/Org1
-echo "Sending invoke transaction on org1/peer0..."
-chaincodeInvoke 0 '{"Args":["invoke","a","b","10"]}' mycc
+#Invoke on chaincode on Peer2/Org2, a belongs to the org2 admin that instantiated the chaincode
+echo "Sending invoke transaction on org2/peer2..."
+chaincodeInvoke 2 '{"Args":["invoke","a","b","10"]}' mycc
 
 # Install chaincode on Peer3/Org2
 echo "Installing chaincode on org2/peer3..."